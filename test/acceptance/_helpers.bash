@@ -1,31 +1,2950 @@
-# name_prefix returns the prefix of the resources within Kubernetes.
+# name_prefix returns the prefix of the resources within Kubernetes. This is
+# also the name of the Helm release, which defaults to "consul" and can be
+# overridden with RELEASE_NAME so that several releases can be installed
+# side by side, e.g. by tests running in parallel.
 name_prefix() {
-    printf "consul"
+    printf "${RELEASE_NAME:-consul}"
+}
+
+# With NAMESPACE_PER_TEST set, each test runs in a namespace of its own
+# that helm_delete deletes along with everything left in it, so that runs
+# sharing a cluster don't collide and a failed cleanup doesn't affect other
+# tests. kubectl and helm are pointed at the namespace through a copy of the
+# kubeconfig whose current context uses it. See use_test_namespace.
+if [ -n "${NAMESPACE_PER_TEST}" ] && [ -z "${TEST_NAMESPACE}" ]; then
+    TEST_NAMESPACE="consul-test-$(hostname | cksum | cut -c1-6)-$$"
+    kubectl config view --raw > "${BATS_TMPDIR}/kubeconfig-${TEST_NAMESPACE}"
+    export KUBECONFIG="${BATS_TMPDIR}/kubeconfig-${TEST_NAMESPACE}"
+    kubectl config set-context --current --namespace "${TEST_NAMESPACE}" > /dev/null
+fi
+
+# use_test_namespace creates the test's namespace if NAMESPACE_PER_TEST is
+# set. helm_install calls it, so only tests that create resources before
+# installing the chart need to call it themselves.
+use_test_namespace() {
+    if [ -n "${TEST_NAMESPACE}" ] && ! kubectl get namespace "${TEST_NAMESPACE}" > /dev/null 2>&1; then
+        register_cleanup --keep-on-failure \
+            kubectl delete --ignore-not-found namespace "${TEST_NAMESPACE}"
+        kubectl create namespace "${TEST_NAMESPACE}"
+    fi
+}
+
+# scaled_timeout outputs the given number of seconds multiplied by
+# TIMEOUT_MULTIPLIER, 1 by default, and rounded up. The helpers that wait
+# derive their timeouts from it, so that e.g. TIMEOUT_MULTIPLIER=2.5 gives
+# slow clusters longer everywhere. Tests should too when they wait
+# themselves, e.g. `kubectl rollout status --timeout=$(scaled_timeout 120)s`.
+scaled_timeout() {
+    awk -v seconds="$1" -v multiplier="${TIMEOUT_MULTIPLIER:-1}" \
+        'BEGIN { t = seconds * multiplier; print (t == int(t) ? t : int(t) + 1) }'
+}
+
+# chart_path outputs the chart that helm_install and helm_upgrade install.
+# This is the chart in this repository unless CHART_PATH is set to another
+# chart directory or to a chart packaged with `helm package`, e.g. to test
+# the artifact that will be published. It fails if the chart doesn't exist.
+chart_path() {
+    local chart="${CHART_PATH:-${BATS_TEST_DIRNAME}/../..}"
+    if [ ! -e "${chart}" ]; then
+        echo "CHART_PATH ${chart} does not exist" >&2
+        return 1
+    fi
+    echo "${chart}"
 }
 
 # helm_install installs the Consul chart. This will source overridable
 # values from the "values.yaml" file in this directory. This can be set
 # by CI or other environments to do test-specific overrides. Note that its
 # easily possible to break tests this way so be careful.
+#
+# Any arguments are passed through to `helm install`, e.g.
+# `helm_install --set 'global.tls.enabled=true'`. Nested values such as
+# lists of gateways are easier to keep in a values file in fixtures, e.g.
+# `helm_install -f "${BATS_TEST_DIRNAME}/fixtures/x-values.yaml"`. As with
+# Helm, later files override earlier ones and `--set` overrides all files.
+#
+# If USE_EXISTING_RELEASE is set, nothing is installed and the tests run
+# against the release named by name_prefix that is already installed. Its
+# values are whatever it was installed with, so only tests that don't
+# depend on their own values will pass.
+#
+# If HELM_ATOMIC is true, a failed install is deleted straight away, after
+# writing diagnostics as for a failed test, rather than in teardown.
 helm_install() {
+    if [ -n "${USE_EXISTING_RELEASE}" ]; then
+        if ! helm status "$(name_prefix)" > /dev/null 2>&1; then
+            echo "USE_EXISTING_RELEASE is set but release $(name_prefix) is not installed"
+            return 1
+        fi
+        echo "Using the existing release $(name_prefix)"
+        return
+    fi
+
+    use_test_namespace
+    grant_openshift_scc
+    local chart overrides
+    chart=$(chart_path) || return 1
+    overrides=$(image_override_args) || return 1
     local values="${BATS_TEST_DIRNAME}/values.yaml"
     if [ ! -f "${values}" ]; then
         touch $values
     fi
 
-    helm install -f ${values} \
-        consul \
+    # This is registered first so that a failed install is cleaned up too.
+    register_cleanup --keep-on-failure delete_release
+
+    if ! run_helm install -f ${values} \
+        --timeout "$(scaled_timeout 300)s" \
+        $(image_registry_args "${chart}") \
+        ${overrides} \
+        $(openshift_args) \
+        $(cloud_provider_args) \
+        "$@" \
+        "$(name_prefix)" \
+        --wait \
+        "${chart}"; then
+        unready_pods_summary
+        if [ "${HELM_ATOMIC}" = "true" ]; then
+            dump_diagnostics "${DEBUG_DIRECTORY:-${BATS_TMPDIR}/consul-helm-debug}"
+            echo "Deleting the failed release $(name_prefix) since HELM_ATOMIC is set"
+            helm delete "$(name_prefix)"
+        fi
+        return 1
+    fi
+}
+
+# assert_install_fails fails unless installing the chart with helm_install
+# and the given arguments fails with an error containing the given
+# message, e.g. for values that the chart rejects.
+# Example: assert_install_fails "connectInject.enabled must be true" --set 'ingressGateways.enabled=true'
+assert_install_fails() {
+    local message=$1
+    shift
+    local output status=0
+    output=$(helm_install "$@" 2>&1) || status=$?
+    echo "${output}"
+
+    if [ ${status} -eq 0 ]; then
+        echo "The install succeeded but was expected to fail with: ${message}"
+        return 1
+    fi
+    if [[ "${output}" != *"${message}"* ]]; then
+        echo "The install failed but not with: ${message}"
+        return 1
+    fi
+}
+
+# run_helm runs helm with the given arguments after printing the exact
+# command line, so that a failed install or upgrade can be reproduced by
+# hand, and records it for dump_diagnostics. helm_install and helm_upgrade
+# run helm through it.
+run_helm() {
+    local command="helm$(printf ' %q' "$@")"
+    echo "Running: ${command}"
+    echo "${command}" >> "${BATS_TMPDIR}/helm-commands-$(name_prefix)"
+    helm "$@"
+}
+
+# release_values outputs every value of the release, i.e. the chart's
+# defaults merged with the values files and flags it was installed or last
+# upgraded with, as YAML. Installing the chart with this output as the only
+# values file reproduces the release.
+release_values() {
+    helm get values --all "$(name_prefix)"
+}
+
+# release_status outputs the status, revision and last deployed time of the
+# release, separated by spaces.
+# Example: read status revision deployed <<< "$(release_status)"
+release_status() {
+    helm status "$(name_prefix)" -o json |
+        jq -r '"\(.info.status) \(.version) \(.info.last_deployed)"'
+}
+
+# release_history outputs the revision and status of each of the release's
+# revisions, oldest first, one per line.
+release_history() {
+    helm history "$(name_prefix)" -o json | jq -r '.[] | "\(.revision) \(.status)"'
+}
+
+# release_resources outputs the kind and name, e.g. StatefulSet/consul-consul-server,
+# of every resource in the release's manifest, one per line.
+release_resources() {
+    helm get manifest "$(name_prefix)" |
+        yq -r 'select(. != null) | "\(.kind)/\(.metadata.name)"' | sort
+}
+
+# assert_release_deployed fails unless the release's status is deployed,
+# as opposed to e.g. failed or pending-upgrade, and, if given, its revision
+# is the given one.
+# Example: assert_release_deployed 2
+assert_release_deployed() {
+    local status revision deployed
+    read status revision deployed <<< "$(release_status)"
+    if [ "${status}" != "deployed" ] || [ "${revision}" != "${1:-${revision}}" ]; then
+        echo "Release $(name_prefix) is at revision ${revision} with status ${status}, expected ${1:+revision $1 with status }deployed:"
+        release_history
+        return 1
+    fi
+}
+
+# helm_install_async starts installing the chart like helm_install with the
+# given arguments but returns right away, so that the test can create
+# fixtures that don't depend on Consul while the install runs. Its output
+# goes to a log that wait_for_install prints. Call install_ready to check
+# on it and wait_for_install before using the release.
+# Example: helm_install_async --set 'connectInject.enabled=true'
+helm_install_async() {
+    # The namespace is created up front so the test can use it right away.
+    use_test_namespace
+    local log="${BATS_TMPDIR}/install-$(name_prefix).log"
+    (
+        helm_install "$@" > "${log}" 2>&1
+        echo $? > "${BATS_TMPDIR}/install-$(name_prefix).status"
+    ) 3>&- &
+    echo $! > "${BATS_TMPDIR}/install-$(name_prefix).pid"
+}
+
+# install_ready succeeds if the install started by helm_install_async has
+# finished successfully, without waiting for it.
+install_ready() {
+    [ "$(cat "${BATS_TMPDIR}/install-$(name_prefix).status" 2> /dev/null)" = "0" ]
+}
+
+# wait_for_install waits for the install started by helm_install_async to
+# finish, prints its output and fails if it did. Its output includes the
+# summary of the pods that weren't ready if it timed out.
+wait_for_install() {
+    local pid="${BATS_TMPDIR}/install-$(name_prefix).pid"
+    if [ ! -f "${pid}" ]; then
+        echo "No install of $(name_prefix) was started with helm_install_async."
+        return 1
+    fi
+
+    while kill -0 "$(cat "${pid}")" 2> /dev/null; do
+        sleep 2
+    done
+    rm -f "${pid}"
+    cat "${BATS_TMPDIR}/install-$(name_prefix).log"
+    rm -f "${BATS_TMPDIR}/install-$(name_prefix).log"
+    install_ready
+    local status=$?
+    rm -f "${BATS_TMPDIR}/install-$(name_prefix).status"
+    return ${status}
+}
+
+# unready_pods_summary prints each of this release's pods that isn't ready
+# along with why: its phase, why it can't be scheduled and why its
+# containers are waiting or were terminated, e.g. "Insufficient cpu" or
+# ImagePullBackOff. helm_install prints it when the install fails so that
+# a timeout says what the install was waiting for.
+unready_pods_summary() {
+    echo "Pods of release $(name_prefix) that are not ready:"
+    kubectl get pods -l "release=$(name_prefix)" -o json | jq -r '.items[] |
+        select([ .status.conditions[]? | select(.type == "Ready") | .status ] != ["True"]) |
+        "  \(.metadata.name): \(.status.phase)" +
+        ([ .status.conditions[]? | select(.type == "PodScheduled" and .status == "False") |
+            ", \(.reason): \(.message)" ] | join("")) +
+        ([ .status.containerStatuses[]? | select(.ready | not) |
+            ", \(.name) \(.state | keys[0]) \(.state[].reason // "")" ] | join(""))'
+}
+
+# image_registry_args outputs the helm flags that make the given chart pull
+# its Consul, consul-k8s and Envoy images from IMAGE_REGISTRY, e.g. a
+# mirror reachable from a cloud or air-gapped cluster, and nothing if it
+# isn't set. The default images are prefixed with the registry, so
+# IMAGE_REGISTRY=mirror.example.com gives mirror.example.com/consul:1.8.1.
+# Images set by a test with --set still take precedence.
+image_registry_args() {
+    if [ -z "${IMAGE_REGISTRY}" ]; then
+        return
+    fi
+
+    local file="${BATS_TMPDIR}/image-registry-values.yaml"
+    helm show values "$1" | awk -v registry="${IMAGE_REGISTRY}" '
+        /^global:/ { global = 1; next }
+        /^[^ #]/ { global = 0 }
+        global && /^  (image|imageK8S|imageEnvoy): / {
+            gsub(/"/, "", $2)
+            images[$1] = registry "/" $2
+        }
+        END {
+            print "global:"
+            print "  image: \"" images["image:"] "\""
+            print "  imageK8S: \"" images["imageK8S:"] "\""
+            print "  imageEnvoy: \"" images["imageEnvoy:"] "\""
+            print "connectInject:"
+            print "  imageEnvoy: \"" images["imageEnvoy:"] "\""
+        }' > "${file}"
+    echo "-f ${file}"
+}
+
+# image_override_args outputs the helm flags that install CONSUL_IMAGE and
+# CONSUL_K8S_IMAGE as global.image and global.imageK8S if they are set,
+# e.g. to run the tests against a pre-release, and fails if either isn't a
+# valid image reference so that a typo fails before anything is installed.
+# Images set by a test with --set still take precedence.
+image_override_args() {
+    local value image
+    for value in "global.image=${CONSUL_IMAGE}" "global.imageK8S=${CONSUL_K8S_IMAGE}"; do
+        image=${value#*=}
+        if [ -z "${image}" ]; then
+            continue
+        fi
+        valid_image_reference "${image}" || return 1
+        echo "--set ${value}"
+    done
+}
+
+# valid_image_reference fails, saying why, unless the given image is a
+# valid reference of the form [registry[:port]/]repository[:tag][@digest].
+# Example: valid_image_reference consul:1.8.1
+valid_image_reference() {
+    local component='[a-z0-9]+([._-]+[a-z0-9]+)*'
+    local registry='([a-zA-Z0-9.-]+(:[0-9]+)?/)?'
+    local tag='(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?'
+    local digest='(@sha256:[a-f0-9]{64})?'
+    if ! [[ "$1" =~ ^${registry}${component}(/${component})*${tag}${digest}$ ]]; then
+        echo "\"$1\" is not a valid image reference" >&2
+        return 1
+    fi
+}
+
+# upgrade_image upgrades the release to the given Consul image, with any
+# other arguments passed on to helm_upgrade, e.g. the values the release
+# was installed with, and waits until the servers and clients have all
+# been rolled and raft is healthy again.
+# Example: upgrade_image consul:1.8.1 --set 'connectInject.enabled=true'
+upgrade_image() {
+    local image=$1
+    shift
+    valid_image_reference "${image}" || return 1
+
+    helm_upgrade --set "global.image=${image}" "$@" || return 1
+    kubectl rollout status --timeout="$(scaled_timeout 300)s" "statefulset/$(name_prefix)-consul-server" &&
+        kubectl rollout status --timeout="$(scaled_timeout 300)s" "daemonset/$(name_prefix)-consul" &&
+        wait_for_raft_healthy "$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.spec.replicas}')"
+}
+
+# is_openshift succeeds if the tests are running against OpenShift. This is
+# detected from the security.openshift.io API unless OPENSHIFT is set to
+# true or false.
+is_openshift() {
+    case "${OPENSHIFT}" in
+        true) return 0 ;;
+        false) return 1 ;;
+    esac
+    kubectl api-versions | grep -q '^security\.openshift\.io/'
+}
+
+# openshift_args outputs the helm flags the chart needs on OpenShift and
+# nothing elsewhere. OpenShift assigns pods an arbitrary fsGroup, so the
+# servers mustn't set one of their own.
+openshift_args() {
+    if is_openshift; then
+        echo "--set server.disableFsGroupSecurityContext=true"
+    fi
+}
+
+# grant_openshift_scc lets every service account in the current namespace
+# use the privileged SecurityContextConstraints on OpenShift, since the
+# clients use host ports and host paths and the tests' fixtures set their
+# own security contexts, none of which the default restricted SCC allows.
+# helm_install calls it and helm_delete removes the grant again.
+grant_openshift_scc() {
+    if ! is_openshift; then
+        return
+    fi
+
+    local namespace=$(kubectl config view --minify -o jsonpath='{..namespace}')
+    register_cleanup kubectl delete --ignore-not-found rolebinding "$(name_prefix)-openshift-scc"
+    kubectl create rolebinding "$(name_prefix)-openshift-scc" \
+        --clusterrole=system:openshift:scc:privileged \
+        --group="system:serviceaccounts:${namespace:-default}" \
+        --dry-run=client -o yaml | kubectl apply -f -
+}
+
+# cloud_provider outputs the kind of Kubernetes cluster the tests run
+# against: kind, eks, gke, aks or, if it can't be told, unknown. It is
+# CLOUD_PROVIDER if that is set and is otherwise detected from the provider
+# ID of the first node.
+cloud_provider() {
+    if [ -n "${CLOUD_PROVIDER}" ]; then
+        echo "${CLOUD_PROVIDER}"
+        return
+    fi
+
+    case "$(kubectl get nodes -o jsonpath='{.items[0].spec.providerID}')" in
+        kind://*) echo "kind" ;;
+        aws://*) echo "eks" ;;
+        gce://*) echo "gke" ;;
+        azure://*) echo "aks" ;;
+        *) echo "unknown" ;;
+    esac
+}
+
+# expect_load_balancer succeeds if LoadBalancer services are assigned an
+# external address in this cluster, which isn't the case on kind.
+# Example: if expect_load_balancer; then ...; fi
+expect_load_balancer() {
+    [ "$(cloud_provider)" != "kind" ]
+}
+
+# The skip_unless helpers skip the current test with the reason when the
+# environment the tests run in lacks what it needs, so that capability
+# checks live here rather than in each test and `bats` output says why a
+# test didn't run. See CONTRIBUTING.md for the variables they check.
+
+# skip_unless_enterprise skips the current test unless the suite has been
+# configured to run against Consul Enterprise by setting CONSUL_ENT_IMAGE
+# to the enterprise image to install.
+skip_unless_enterprise() {
+    if [ -z "${CONSUL_ENT_IMAGE}" ]; then
+        skip "requires Consul Enterprise, set CONSUL_ENT_IMAGE to its image"
+    fi
+}
+
+# skip_unless_secondary_cluster skips the current test unless a second
+# Kubernetes cluster to install a secondary datacenter into has been
+# configured by setting SECONDARY_KUBECONTEXT to its kubectl context. If
+# the context isn't in the default kubeconfig, SECONDARY_KUBECONFIG must
+# also be set to the kubeconfig file it is in.
+skip_unless_secondary_cluster() {
+    if [ -z "${SECONDARY_KUBECONTEXT}" ]; then
+        skip "requires a second cluster, set SECONDARY_KUBECONTEXT to its context"
+    fi
+}
+
+# skip_unless_external_servers skips the current test unless a Consul
+# cluster running outside of Kubernetes has been configured by setting
+# EXTERNAL_SERVERS_ADDR to the address of its servers, see
+# helm_install_external_servers.
+skip_unless_external_servers() {
+    if [ -z "${EXTERNAL_SERVERS_ADDR}" ]; then
+        skip "requires external Consul servers, set EXTERNAL_SERVERS_ADDR to their address"
+    fi
+}
+
+# skip_unless_load_balancer skips the current test unless LoadBalancer
+# services are assigned an external address, see expect_load_balancer.
+skip_unless_load_balancer() {
+    if ! expect_load_balancer; then
+        skip "requires LoadBalancer services, which get no external address on $(cloud_provider)"
+    fi
+}
+
+# skip_unless_image_registry skips the current test unless IMAGE_REGISTRY
+# is set to a registry mirroring the chart's images.
+skip_unless_image_registry() {
+    if [ -z "${IMAGE_REGISTRY}" ]; then
+        skip "requires an image registry, set IMAGE_REGISTRY to it"
+    fi
+}
+
+# skip_unless_volume_expansion skips the current test unless the storage
+# class of the servers' PVCs allows volumes to be expanded. The release
+# must be installed already.
+skip_unless_volume_expansion() {
+    local class=$(kubectl get pvc -l "release=$(name_prefix)" -o jsonpath='{.items[0].spec.storageClassName}')
+    if [ "$(kubectl get storageclass "${class}" -o jsonpath='{.allowVolumeExpansion}')" != "true" ]; then
+        skip "requires volume expansion, which storage class ${class} doesn't allow"
+    fi
+}
+
+# cloud_provider_args outputs the helm flags for the settings that differ
+# between clouds and nothing if none apply. With INTERNAL_LOAD_BALANCER set,
+# the mesh and ingress gateways' services get the annotation that makes
+# cloud_provider's load balancers internal, for clusters whose tests run
+# inside the same network. STORAGE_CLASS sets the servers' storage class
+# when the cluster's default class isn't the one to test with.
+cloud_provider_args() {
+    local annotation=""
+    if [ -n "${INTERNAL_LOAD_BALANCER}" ]; then
+        case "$(cloud_provider)" in
+            eks) annotation='"service.beta.kubernetes.io/aws-load-balancer-internal": "true"' ;;
+            gke) annotation='"networking.gke.io/load-balancer-type": "Internal"' ;;
+            aks) annotation='"service.beta.kubernetes.io/azure-load-balancer-internal": "true"' ;;
+        esac
+    fi
+    if [ -z "${annotation}" ] && [ -z "${STORAGE_CLASS}" ]; then
+        return
+    fi
+
+    local file="${BATS_TMPDIR}/cloud-provider-values.yaml"
+    : > "${file}"
+    if [ -n "${annotation}" ]; then
+        cat >> "${file}" <<EOT
+meshGateway:
+  service:
+    annotations: |
+      ${annotation}
+ingressGateways:
+  defaults:
+    service:
+      annotations: |
+        ${annotation}
+EOT
+    fi
+    if [ -n "${STORAGE_CLASS}" ]; then
+        cat >> "${file}" <<EOT
+server:
+  storageClass: "${STORAGE_CLASS}"
+EOT
+    fi
+    echo "-f ${file}"
+}
+
+# helm_upgrade upgrades the Consul release installed by helm_install using
+# the same overridable values file. Any arguments are passed through to
+# `helm upgrade`. Helm decides which of the release's values are kept: with
+# Helm 3, the values it was installed with are reused only if the upgrade
+# sets no values at all. Use helm_upgrade_reset when a test turns a feature
+# off.
+#
+# If HELM_ATOMIC is true, a failed upgrade is rolled back to the previous
+# revision after writing diagnostics as for a failed test. The rollback
+# doesn't wait, since a StatefulSet doesn't replace a pod that never became
+# ready.
+helm_upgrade() {
+    if [ -n "${USE_EXISTING_RELEASE}" ]; then
+        skip "helm_upgrade would change the existing release $(name_prefix)"
+    fi
+
+    local chart overrides
+    chart=$(chart_path) || return 1
+    overrides=$(image_override_args) || return 1
+    if ! run_helm upgrade -f "${BATS_TEST_DIRNAME}/values.yaml" \
+        --timeout "$(scaled_timeout 300)s" \
+        $(image_registry_args "${chart}") \
+        ${overrides} \
+        $(openshift_args) \
+        $(cloud_provider_args) \
+        "$@" \
+        "$(name_prefix)" \
+        --wait \
+        "${chart}"; then
+        if [ "${HELM_ATOMIC}" = "true" ]; then
+            unready_pods_summary
+            dump_diagnostics "${DEBUG_DIRECTORY:-${BATS_TMPDIR}/consul-helm-debug}"
+            echo "Rolling back the failed upgrade of $(name_prefix) since HELM_ATOMIC is set"
+            run_helm rollback "$(name_prefix)"
+        fi
+        return 1
+    fi
+}
+
+# helm_upgrade_reset upgrades the release like helm_upgrade but with
+# --reset-values, so only the chart's defaults, the overridable values file
+# and the given arguments apply and nothing the release was installed or
+# last upgraded with is kept. This makes sure that turning a feature off
+# leaves it off, e.g. after installing with global.tls.enabled=true,
+# `helm_upgrade_reset --set 'connectInject.enabled=true'` disables TLS.
+helm_upgrade_reset() {
+    helm_upgrade --reset-values "$@"
+}
+
+# helm_delete cleans up after a test: it runs every cleanup registered with
+# register_cleanup, which includes deleting the release installed by
+# helm_install and the config entries, secrets and other resources that
+# helpers created, in the reverse order they were registered. With
+# USE_EXISTING_RELEASE the release wasn't installed by the test so only the
+# resources the test created are deleted.
+helm_delete() {
+    # An install started by helm_install_async that the test didn't wait
+    # for, e.g. because it failed first, has to finish before cleaning up.
+    if [ -f "${BATS_TMPDIR}/install-$(name_prefix).pid" ]; then
+        wait_for_install || true
+    fi
+    dump_diagnostics_on_failure
+    stop_port_forwards
+
+    local status=0
+    run_cleanups || status=1
+    rm -f "${BATS_TMPDIR}/helm-commands-$(name_prefix)"
+    if [ -n "${TEST_NAMESPACE}" ]; then
+        rm -f "${BATS_TMPDIR}/kubeconfig-${TEST_NAMESPACE}"
+    fi
+    return ${status}
+}
+
+# delete_release deletes the Consul chart and all its resources. The PVCs
+# of the servers and the secrets created by the chart's jobs, such as the
+# ACL bootstrap token and the CA, aren't owned by the release so they are
+# deleted explicitly. Only those belonging to this release are deleted so
+# that other releases are unaffected. Each deleted resource is logged and
+# it is safe to call this when the release or resources are already gone.
+# helm_install registers it as a cleanup.
+delete_release() {
+    if helm status "$(name_prefix)" > /dev/null 2>&1; then
+        helm delete "$(name_prefix)"
+    fi
+
+    local resources=$(
+        kubectl get pvc -l "release=$(name_prefix)" -o name
+        kubectl get secrets -o name | grep "^secret/$(name_prefix)-consul-"
+    )
+    for resource in ${resources}; do
+        echo "Deleting ${resource}"
+        kubectl delete --ignore-not-found "${resource}"
+    done
+}
+
+# register_cleanup registers the given command to be run by helm_delete
+# when the current test ends. Cleanups run in the reverse order they were
+# registered, so e.g. config entries are deleted before the release and
+# the release before its namespace. Every cleanup runs even if an earlier
+# one fails, and helm_delete then fails listing each that did. With
+# --keep-on-failure the cleanup is skipped if the test failed and
+# NO_CLEANUP_ON_FAILURE is set, which helm_install uses so that a failed
+# release can be inspected while the test's other resources are still
+# removed.
+# Example: register_cleanup kubectl delete --ignore-not-found configmap my-config
+register_cleanup() {
+    local keep="false"
+    if [ "$1" = "--keep-on-failure" ]; then
+        keep="true"
+        shift
+    fi
+    echo "${keep} $(printf '%q ' "$@")" >> "${BATS_TMPDIR}/cleanups-$(name_prefix)"
+}
+
+# run_cleanups runs the cleanups registered with register_cleanup, see
+# register_cleanup. helm_delete calls it.
+run_cleanups() {
+    local cleanups="${BATS_TMPDIR}/cleanups-$(name_prefix)"
+    if [ ! -f "${cleanups}" ]; then
+        return
+    fi
+
+    local failed=""
+    local test_failed=""
+    if [ -z "${BATS_TEST_COMPLETED}" ] && [ -z "${BATS_TEST_SKIPPED}" ]; then
+        test_failed="true"
+    fi
+
+    local keep command
+    while read -r keep command; do
+        if [ "${keep}" = "true" ] && [ -n "${test_failed}" ] && [ -n "${NO_CLEANUP_ON_FAILURE}" ]; then
+            echo "Skipping cleanup since the test failed: ${command}"
+            continue
+        fi
+        if ! eval "${command}" < /dev/null; then
+            failed="${failed}
+  ${command}"
+        fi
+    done < <(awk '{ lines[NR] = $0 } END { for (i = NR; i > 0; i--) print lines[i] }' "${cleanups}")
+    rm -f "${cleanups}"
+
+    if [ -n "${failed}" ]; then
+        echo "These cleanups failed:${failed}"
+        return 1
+    fi
+}
+
+# dump_diagnostics writes the logs and `kubectl describe` output of every
+# pod of this release and every connect-injected pod, along with the
+# namespace's events, the helm commands run by run_helm, the release's
+# values and revision history, and whether each resource in its manifest
+# exists in the cluster, to a new directory named after the current test
+# under the given directory.
+# Example: dump_diagnostics /tmp/debug
+dump_diagnostics() {
+    local dir="$1/$(echo "${BATS_TEST_NAME}" | tr -c 'a-zA-Z0-9-\n' '_')-$(date +%Y%m%d%H%M%S)"
+    mkdir -p "${dir}"
+
+    local pods=$(kubectl get pods -o json | jq -r --arg release "$(name_prefix)" '.items[] | select(
+        .metadata.labels.release == $release or
+        .metadata.annotations["consul.hashicorp.com/connect-inject-status"] == "injected"
+    ) | .metadata.name')
+    for pod in ${pods}; do
+        kubectl logs ${pod} --all-containers --prefix > "${dir}/${pod}.log" 2>&1
+        kubectl describe pod ${pod} > "${dir}/${pod}.describe" 2>&1
+    done
+    kubectl get events --sort-by=.lastTimestamp > "${dir}/events" 2>&1
+    cp "${BATS_TMPDIR}/helm-commands-$(name_prefix)" "${dir}/helm-commands" 2> /dev/null
+    release_values > "${dir}/values.yaml" 2>&1
+    release_history > "${dir}/history" 2>&1
+    for resource in $(release_resources 2> /dev/null); do
+        if kubectl get "${resource}" > /dev/null 2>&1; then
+            echo "${resource} present"
+        else
+            echo "${resource} missing"
+        fi
+    done > "${dir}/resources"
+
+    echo "Diagnostics written to ${dir}"
+}
+
+# dump_diagnostics_on_failure calls dump_diagnostics if the current test
+# failed, writing to DEBUG_DIRECTORY or, if it isn't set, a directory in
+# BATS_TMPDIR. It is called by helm_delete so it runs in teardown before
+# anything is removed.
+dump_diagnostics_on_failure() {
+    if [ -z "${BATS_TEST_COMPLETED}" ] && [ -z "${BATS_TEST_SKIPPED}" ]; then
+        dump_diagnostics "${DEBUG_DIRECTORY:-${BATS_TMPDIR}/consul-helm-debug}"
+    fi
+}
+
+# pod_uids outputs the sorted UIDs of the pods matching the given label
+# selector. Comparing the output before and after an operation shows
+# whether any of the pods were recreated.
+# Example: pod_uids component=server
+pod_uids() {
+    kubectl get pods -l "release=$(name_prefix),$1" -o json |
+        jq -r '[ .items[].metadata.uid ] | sort | join(",")'
+}
+
+# rbac_objects outputs the sorted, comma-separated kinds and names of the
+# ServiceAccounts, Roles and RoleBindings of this release matching the
+# given label selector. It outputs nothing once a disabled component's
+# identity and privileges have been cleaned up.
+# Example: rbac_objects component=ingress-gateway
+rbac_objects() {
+    kubectl get serviceaccounts,roles,rolebindings -l "release=$(name_prefix),$1" -o json |
+        jq -r '[ .items[] | .kind + "/" + .metadata.name ] | sort | join(",")'
+}
+
+# service_endpoints outputs the sorted, comma-separated IPs the given
+# Service routes traffic to, i.e. the ready addresses of its Endpoints.
+service_endpoints() {
+    kubectl get endpoints "$1" -o json |
+        jq -r '[ .subsets[]?.addresses[]?.ip ] | sort | join(",")'
+}
+
+# ready_pod_ips outputs the sorted, comma-separated IPs of the pods of this
+# release matching the given label selector that are Ready and not being
+# deleted.
+# Example: ready_pod_ips component=ingress-gateway
+ready_pod_ips() {
+    kubectl get pods -l "release=$(name_prefix),$1" -o json |
+        jq -r '[
+            .items[] |
+            select(.metadata.deletionTimestamp == null) |
+            select(any(.status.conditions[]?; .type == "Ready" and .status == "True")) |
+            .status.podIP
+        ] | sort | join(",")'
+}
+
+# assert_service_endpoints_ready waits until the given Service routes to
+# exactly the Ready pods matching the given label selector, and fails with
+# both sets if it never does.
+# Example: assert_service_endpoints_ready consul-consul-ingress-gateway component=ingress-gateway
+assert_service_endpoints_ready() {
+    local endpoints ready
+    for i in $(seq 30); do
+        endpoints=$(service_endpoints $1)
+        ready=$(ready_pod_ips $2)
+        if [ "${endpoints}" = "${ready}" ]; then
+            echo "$1 routes to the ready pods: ${endpoints}"
+            return
+        fi
+
+        echo "Waiting for $1 (${endpoints}) to route to the ready pods (${ready})..."
+        sleep 2
+    done
+
+    echo "$1 (${endpoints}) never routed to the ready pods (${ready})."
+    return 1
+}
+
+# port_forward forwards the given local port to the given remote port of
+# the given pod or service, e.g. svc/consul-consul-ui, in the background
+# and waits until the local port accepts connections. The forward is
+# stopped with stop_port_forward, or at the latest by helm_delete.
+# Example: port_forward "svc/$(name_prefix)-consul-ui" 18500 80
+port_forward() {
+    local log="${BATS_TMPDIR}/port-forward-$2.log"
+    kubectl port-forward "$1" "$2:$3" > "${log}" 2>&1 3>&- &
+    echo $! > "${BATS_TMPDIR}/port-forward-$2.pid"
+
+    for i in $(seq 30); do
+        if (exec 3<> "/dev/tcp/127.0.0.1/$2") 2> /dev/null; then
+            return
+        fi
+        if ! port_forward_alive $2; then
+            echo "The port forward from $2 to $1 exited:"
+            cat "${log}"
+            return 1
+        fi
+        sleep 1
+    done
+
+    echo "The port forward from $2 to $1 never accepted connections."
+    stop_port_forward $2
+    return 1
+}
+
+# port_forward_alive succeeds if the port forward started by port_forward
+# for the given local port is still running.
+port_forward_alive() {
+    kill -0 "$(cat "${BATS_TMPDIR}/port-forward-$1.pid" 2> /dev/null)" 2> /dev/null
+}
+
+# stop_port_forward stops the port forward started by port_forward for the
+# given local port.
+stop_port_forward() {
+    local pid_file="${BATS_TMPDIR}/port-forward-$1.pid"
+    if [ -f "${pid_file}" ]; then
+        kill "$(cat "${pid_file}")" 2> /dev/null || true
+        rm -f "${pid_file}" "${BATS_TMPDIR}/port-forward-$1.log"
+    fi
+}
+
+# stop_port_forwards stops every port forward started by port_forward.
+stop_port_forwards() {
+    for pid_file in "${BATS_TMPDIR}"/port-forward-*.pid; do
+        if [ -f "${pid_file}" ]; then
+            local port=${pid_file##*/port-forward-}
+            stop_port_forward ${port%.pid}
+        fi
+    done
+}
+
+# KUBECTL_RETRY_ATTEMPTS and KUBECTL_RETRY_INTERVAL are how often
+# kubectl_retry runs a command that fails with a transient error and how
+# many seconds it waits before the first retry, doubling after each.
+KUBECTL_RETRY_ATTEMPTS=${KUBECTL_RETRY_ATTEMPTS:-5}
+KUBECTL_RETRY_INTERVAL=${KUBECTL_RETRY_INTERVAL:-1}
+
+# set_kubectl_retry_policy sets how often kubectl_retry runs a command that
+# fails with a transient error and how many seconds it waits before the
+# first retry. Tests that expect the API server to be unavailable for a while can
+# raise them, and 1 attempt turns retries off.
+# Example: set_kubectl_retry_policy 10 2
+set_kubectl_retry_policy() {
+    KUBECTL_RETRY_ATTEMPTS=$1
+    KUBECTL_RETRY_INTERVAL=$2
+}
+
+# kubectl_transient_error succeeds if the given kubectl error output is one
+# that is worth retrying, i.e. the API server or etcd was briefly
+# unavailable rather than the request being wrong, e.g. NotFound.
+kubectl_transient_error() {
+    grep -qiE \
+        -e 'connection to the server .* was refused' \
+        -e 'connection refused' \
+        -e 'connection reset by peer' \
+        -e 'TLS handshake timeout' \
+        -e 'i/o timeout' \
+        -e 'etcdserver: (request timed out|leader changed)' \
+        -e 'the server is currently unable to handle the request' \
+        -e 'http2: client connection lost' \
+        <<< "$1"
+}
+
+# kubectl_retry runs kubectl with the given read-only command, i.e. get,
+# describe or logs, and retries it with backoff while it fails with a
+# transient error, see kubectl_transient_error and
+# set_kubectl_retry_policy. Other failures are returned straight away. The
+# command's output is printed once it has finished, so it refuses to
+# follow logs or watch. Use it for reads that are expected to race with
+# the API server being briefly unavailable, e.g. while polling.
+# Example: kubectl_retry get pods -l app=static-server -o name
+kubectl_retry() {
+    case "$1" in
+        get|describe|logs) ;;
+        *)
+            echo "kubectl_retry: only get, describe and logs are retried, not $1" >&2
+            return 1
+            ;;
+    esac
+    local arg i
+    for arg in "$@"; do
+        case "${arg}" in
+            -f|--follow|-w|--watch|--watch-only)
+                echo "kubectl_retry: $1 ${arg} doesn't finish, run it with kubectl" >&2
+                return 1
+                ;;
+        esac
+    done
+
+    local out=$(mktemp) err=$(mktemp)
+    local interval=${KUBECTL_RETRY_INTERVAL} status
+    for i in $(seq ${KUBECTL_RETRY_ATTEMPTS}); do
+        kubectl "$@" > "${out}" 2> "${err}"
+        status=$?
+        if [ ${status} -eq 0 ] || ! kubectl_transient_error "$(cat "${err}")" ||
+                [ $i -eq ${KUBECTL_RETRY_ATTEMPTS} ]; then
+            break
+        fi
+        echo "kubectl $* failed with a transient error, retrying in ${interval}s: $(head -n 1 "${err}")" >&2
+        sleep ${interval}
+        interval=$((interval * 2))
+    done
+
+    cat "${out}"
+    cat "${err}" >&2
+    rm -f "${out}" "${err}"
+    return ${status}
+}
+
+# kubectl_apply_template applies the given fixture after replacing each
+# ${NAME} placeholder in it with the value given for it as NAME=value, and
+# registers a cleanup that deletes what was applied. It fails without
+# applying anything if a placeholder has no value. With -n it applies the
+# fixture to the given namespace. Apply fixtures without placeholders with
+# kubectl apply.
+# Example: kubectl_apply_template -n other "${BATS_TMPDIR}/app.yaml" IMAGE=hashicorp/http-echo:latest
+kubectl_apply_template() {
+    local namespace=""
+    if [ "$1" = "-n" ]; then
+        namespace=$2
+        shift 2
+    fi
+    local template=$1
+    shift
+    local rendered="${BATS_TMPDIR}/$(name_prefix)-${namespace:+${namespace}-}$(basename "${template}")"
+    local content=$(cat "${template}")
+    local name value
+    for assignment in "$@"; do
+        name=${assignment%%=*}
+        value=${assignment#*=}
+        content=${content//"\${${name}}"/"${value}"}
+    done
+
+    local missing=$(echo "${content}" | grep -o '\${[A-Z_][A-Z0-9_]*}' | sort -u | tr '\n' ' ')
+    if [ -n "${missing}" ]; then
+        echo "No values were given for ${missing}in ${template}"
+        return 1
+    fi
+
+    echo "${content}" > "${rendered}"
+    register_cleanup rm -f "${rendered}"
+    register_cleanup kubectl ${namespace:+-n "${namespace}"} delete --ignore-not-found -f "${rendered}"
+    kubectl ${namespace:+-n "${namespace}"} apply -f "${rendered}"
+}
+
+# deploy_static_server deploys the static-server fixture, an HTTP server
+# that responds with "hello world", waits until it has rolled out and
+# outputs the name of its pod. Its Deployment and Service are named
+# static-server and its pods are labelled app=static-server. The fixture is
+# deleted by helm_delete. --no-inject deploys it without connect-inject and
+# --namespace in the given namespace instead of the current one.
+# Example: local server=$(deploy_static_server --namespace other)
+deploy_static_server() {
+    deploy_fixture static-server "$@"
+}
+
+# deploy_static_client deploys the static-client fixture, a pod with curl
+# that has static-server as an upstream on localhost:1234, waits until it
+# has rolled out and outputs the name of its pod. Its Deployment is named
+# static-client and its pods are labelled app=static-client. It takes the
+# same options as deploy_static_server as well as --upstreams to set the
+# pod's consul.hashicorp.com/connect-service-upstreams annotation instead.
+# Example: local client=$(deploy_static_client --upstreams static-server:1234:dc2)
+deploy_static_client() {
+    deploy_fixture static-client "$@"
+}
+
+# deploy_fixture implements deploy_static_server and deploy_static_client
+# for the fixture of the given name. The fixture is applied as it is apart
+# from its Deployment's connect-inject and, if it has one, upstreams
+# annotations, so that it stays the only copy of the test app. Progress
+# goes to stderr so that only the pod's name is output.
+deploy_fixture() {
+    local name=$1
+    shift
+    local inject=true namespace="" upstreams="static-server:1234"
+    while [ $# -gt 0 ]; do
+        case "$1" in
+            --no-inject) inject=false; shift ;;
+            --namespace) namespace=$2; shift 2 ;;
+            --upstreams) upstreams=$2; shift 2 ;;
+            *) echo "deploy_${name//-/_}: unknown option $1" >&2; return 1 ;;
+        esac
+    done
+
+    local rendered="${BATS_TMPDIR}/$(name_prefix)-${namespace:+${namespace}-}${name}.yaml"
+    yq -y --arg inject "${inject}" --arg upstreams "${upstreams}" '
+        if .kind == "Deployment" then
+            .spec.template.metadata.annotations["consul.hashicorp.com/connect-inject"] = $inject |
+            if .spec.template.metadata.annotations | has("consul.hashicorp.com/connect-service-upstreams") then
+                .spec.template.metadata.annotations["consul.hashicorp.com/connect-service-upstreams"] = $upstreams
+            else . end
+        else . end' "${BATS_TEST_DIRNAME}/fixtures/${name}.yaml" > "${rendered}" || return 1
+    register_cleanup rm -f "${rendered}"
+    register_cleanup kubectl ${namespace:+-n "${namespace}"} delete --ignore-not-found -f "${rendered}"
+
+    kubectl ${namespace:+-n "${namespace}"} apply -f "${rendered}" >&2 &&
+        kubectl ${namespace:+-n "${namespace}"} rollout status \
+            --timeout="$(scaled_timeout 120)s" "deploy/${name}" >&2 || return 1
+    kubectl ${namespace:+-n "${namespace}"} get pods -l "app=${name}" \
+        --field-selector=status.phase=Running -o jsonpath='{.items[0].metadata.name}'
+}
+
+# config_write writes the config entry in the given HCL or JSON file to
+# Consul through the first server, fails unless it can then be read back
+# and registers a cleanup so that helm_delete deletes it, even when the
+# test fails part way through. This matters when the servers outlive
+# the release, e.g. with externalServers.
+# Example: config_write "${BATS_TEST_DIRNAME}/fixtures/service-defaults.hcl"
+config_write() {
+    local kind name
+    if jq -e . "$1" > /dev/null 2>&1; then
+        kind=$(jq -r .Kind "$1")
+        name=$(jq -r .Name "$1")
+    else
+        kind=$(sed -n 's/^Kind *= *"\(.*\)"/\1/p' "$1")
+        name=$(sed -n 's/^Name *= *"\(.*\)"/\1/p' "$1")
+    fi
+
+    register_cleanup delete_config_entry "${kind}" "${name}"
+    kubectl exec -i "$(name_prefix)-consul-server-0" -- consul config write - < "$1"
+    kubectl exec "$(name_prefix)-consul-server-0" -- \
+        consul config read -kind "${kind}" -name "${name}" > /dev/null
+}
+
+# set_service_defaults writes a service-defaults config entry setting the
+# protocol of the given service, with the same cleanup as config_write.
+# Example: set_service_defaults static-server http
+set_service_defaults() {
+    local file="${BATS_TMPDIR}/service-defaults-$1.json"
+    jq -n --arg name "$1" --arg protocol "$2" \
+        '{Kind: "service-defaults", Name: $name, Protocol: $protocol}' > "${file}"
+    config_write "${file}"
+}
+
+# set_proxy_defaults writes the global proxy-defaults config entry with the
+# given JSON object as its Config, with the same cleanup as config_write.
+# Example: set_proxy_defaults '{"protocol": "http"}'
+set_proxy_defaults() {
+    local file="${BATS_TMPDIR}/proxy-defaults.json"
+    jq -n --argjson config "$1" \
+        '{Kind: "proxy-defaults", Name: "global", Config: $config}' > "${file}"
+    config_write "${file}"
+}
+
+# wait_for_upstream_protocol waits until the Envoy in the given pod proxies
+# the upstream service of the given name with the given protocol, i.e. its
+# listener uses the HTTP connection manager for http, http2 and grpc and
+# the TCP proxy otherwise, and fails if it never does. This shows when a
+# change to service-defaults or proxy-defaults has reached the proxy.
+# Example: wait_for_upstream_protocol static-client-abc123 static-server http
+wait_for_upstream_protocol() {
+    local filter="envoy.tcp_proxy"
+    case "$3" in
+        http|http2|grpc) filter="envoy.http_connection_manager" ;;
+    esac
+
+    local filters
+    for i in $(seq 30); do
+        filters=$(envoy_admin $1 /config_dump | jq -r --arg service "$2" '
+            .configs[] | .dynamic_listeners[]? |
+            select(.name | startswith($service + ":")) |
+            .active_state.listener.filter_chains[].filters[].name')
+        if echo "${filters}" | grep -qx "${filter}"; then
+            echo "The upstream $2 in $1 is proxied as $3"
+            return
+        fi
+        sleep 2
+    done
+
+    echo "The upstream $2 in $1 was never proxied as $3, its filters are: ${filters}"
+    return 1
+}
+
+# create_secret creates a generic secret of the given name holding the given
+# key=value literals and registers a cleanup so that helm_delete deletes it.
+# It fails if a secret of that name already exists rather than reusing it.
+# Example: create_secret consul-gossip-encryption-key key="$(openssl rand -base64 32)"
+create_secret() {
+    local name=$1
+    shift
+
+    local literals=()
+    for literal in "$@"; do
+        literals+=(--from-literal="${literal}")
+    done
+
+    use_test_namespace
+    kubectl create secret generic "${name}" "${literals[@]}" || return 1
+    register_cleanup kubectl delete --ignore-not-found secret "${name}"
+}
+
+# create_tls_secret is like create_secret but creates a TLS secret of the
+# given name from the given PEM encoded certificate and key files, stored
+# under the tls.crt and tls.key keys.
+# Example: create_tls_secret consul-ca "${BATS_TMPDIR}/ca.pem" "${BATS_TMPDIR}/ca-key.pem"
+create_tls_secret() {
+    use_test_namespace
+    kubectl create secret tls "$1" --cert="$2" --key="$3" || return 1
+    register_cleanup kubectl delete --ignore-not-found secret "$1"
+}
+
+# kv_put writes the given value to the given key in Consul's KV store with
+# consul_exec, so CONSUL_HTTP_TOKEN is used if it is set, and registers a
+# cleanup so that helm_delete deletes the key with the same token. An
+# optional third argument is the datacenter to write to.
+# Example: kv_put config/greeting hello
+kv_put() {
+    register_cleanup CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN}" \
+        consul_exec kv delete ${3:+-datacenter="$3"} "$1"
+    consul_exec kv put ${3:+-datacenter="$3"} "$1" "$2"
+}
+
+# assert_kv waits until the given key in Consul's KV store has the given
+# value and fails with the value it does have if it never does. An optional
+# third argument is the datacenter to read from.
+# Example: assert_kv config/greeting hello dc2
+assert_kv() {
+    local value
+    for i in $(seq 30); do
+        value=$(consul_exec kv get ${3:+-datacenter="$3"} "$1")
+        if [ "${value}" = "$2" ]; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "Expected $1 to be \"$2\" but it is: ${value}"
+    return 1
+}
+
+# register_external_service registers a service running outside the mesh at
+# the given address and port in the catalog, on a node named external-node,
+# so that it can be linked to a terminating gateway. The service is
+# deregistered by helm_delete.
+# Example: register_external_service external-server external-server.default.svc.cluster.local 80
+register_external_service() {
+    jq -n --arg name "$1" --arg address "$2" --argjson port "$3" '{
+        Node: "external-node",
+        Address: $address,
+        NodeMeta: {"external-node": "true", "external-probe": "true"},
+        Service: {Service: $name, Address: $address, Port: $port}
+    }' | consul_api_put /v1/catalog/register || return 1
+    echo
+    register_cleanup deregister_external_service "$1"
+}
+
+# deregister_external_service deregisters the given service registered by
+# register_external_service.
+deregister_external_service() {
+    echo "Deregistering external service $1"
+    jq -n --arg service "$1" '{Node: "external-node", ServiceID: $service}' |
+        consul_api_put /v1/catalog/deregister
+}
+
+# link_terminating_gateway writes the terminating-gateway config entry of
+# the given gateway linking it to the given services, e.g. ones registered
+# with register_external_service, and removes it again in helm_delete. Use
+# config_write with a fixture instead for links that need TLS settings.
+# When the chart manages ACLs, the gateway's token is also given write
+# access to the services as the gateway needs to represent them.
+# Example: link_terminating_gateway terminating-gateway external-server
+link_terminating_gateway() {
+    local gateway=$1
+    shift
+    local file="${BATS_TMPDIR}/terminating-gateway-${gateway}.json"
+    printf '%s\n' "$@" | jq -R . | jq -s --arg gateway "${gateway}" '{
+        Kind: "terminating-gateway",
+        Name: $gateway,
+        Services: map({Name: .})
+    }' > "${file}"
+
+    if kubectl get secret "$(name_prefix)-consul-bootstrap-acl-token" > /dev/null 2>&1; then
+        CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN:-$(acl_bootstrap_token)}" \
+            grant_terminating_gateway_write "${gateway}" "$@" || return 1
+    fi
+    config_write "${file}"
+}
+
+# grant_terminating_gateway_write creates a policy with write access to the
+# given services and adds it to the ACL token that server-acl-init created
+# for the given terminating gateway.
+grant_terminating_gateway_write() {
+    local gateway=$1
+    shift
+    local accessor
+    accessor=$(consul_exec acl token list -format=json |
+        jq -r --arg name "${gateway}-terminating-gateway-token" \
+            '.[] | select(.Description | contains($name)) | .AccessorID')
+    if [ -z "${accessor}" ]; then
+        echo "There is no ACL token for terminating gateway ${gateway}."
+        return 1
+    fi
+
+    local rules="" service
+    for service in "$@"; do
+        rules="${rules}service \"${service}\" { policy = \"write\" }
+"
+    done
+    # The policy exists already if the gateway was linked before, e.g. in an
+    # existing release.
+    local policy="${gateway}-linked-services-write"
+    if consul_exec acl policy read -name "${policy}" > /dev/null; then
+        consul_exec acl policy update -name "${policy}" -rules "${rules}"
+    else
+        consul_exec acl policy create -name "${policy}" -rules "${rules}"
+    fi || return 1
+    consul_exec acl token update -id "${accessor}" \
+        -policy-name "${policy}" \
+        -merge-policies -merge-roles -merge-service-identities
+}
+
+# delete_config_entry deletes the config entry of the given kind and name
+# that config_write wrote. Entries that no longer exist are ignored.
+delete_config_entry() {
+    echo "Deleting config entry $1/$2"
+    kubectl exec "$(name_prefix)-consul-server-0" -- \
+        consul config delete -kind "$1" -name "$2" || true
+}
+
+# reset_consul_state deletes the config entries, intentions and KV data
+# that tests create, so that tests sharing a release, e.g. with
+# USE_EXISTING_RELEASE, don't see each other's leftovers. ACL tokens,
+# policies and the catalog are left alone, as are the config entries the
+# chart creates itself, i.e. the global proxy-defaults. When the chart
+# manages ACLs the bootstrap token is used unless CONSUL_HTTP_TOKEN is set.
+reset_consul_state() {
+    local CONSUL_HTTP_TOKEN=${CONSUL_HTTP_TOKEN:-$(acl_bootstrap_token 2> /dev/null)}
+
+    # Config entries that others depend on, e.g. the service-resolver a
+    # service-router routes to, can only be deleted after their dependents.
+    local kind name
+    for kind in ingress-gateway terminating-gateway service-router service-splitter \
+            service-resolver service-defaults proxy-defaults; do
+        for name in $(consul_api "/v1/config/${kind}" | jq -r '.[]?.Name'); do
+            if [ "${kind}/${name}" = "proxy-defaults/global" ]; then
+                continue
+            fi
+            consul_exec config delete -kind "${kind}" -name "${name}" || return 1
+        done
+    done
+
+    local id
+    for id in $(consul_api /v1/connect/intentions | jq -r '.[]?.ID'); do
+        consul_exec intention delete "${id}" || return 1
+    done
+
+    local key
+    for key in $(consul_exec kv get -keys); do
+        consul_exec kv delete -recurse "${key}" || return 1
+    done
+}
+
+# pvc_sizes outputs the sorted, comma-separated capacities of this
+# release's PVCs as reported in their status, i.e. after any resize has
+# completed.
+pvc_sizes() {
+    kubectl get pvc -l "release=$(name_prefix)" -o json |
+        jq -r '[ .items[].status.capacity.storage ] | sort | join(",")'
+}
+
+# consul_exec runs the consul CLI with the given arguments in the server
+# container of the first server pod of this release, or of CONSUL_EXEC_POD
+# if it is set, and outputs its combined output. The CLI finds the servers
+# through the container's environment, which points it at HTTPS when TLS
+# is enabled, and CONSUL_HTTP_TOKEN is passed through if it is set.
+# Example: consul_exec operator raft list-peers
+consul_exec() {
+    local pod="${CONSUL_EXEC_POD:-$(pod_name "release=$(name_prefix),component=server")}"
+    kubectl exec "${pod}" -c consul -- \
+        env ${CONSUL_HTTP_TOKEN:+CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN}"} consul "$@" 2>&1
+}
+
+# acl_bootstrap_token outputs the ACL bootstrap token that the server-acl-init
+# job stored when the release was installed with
+# global.acls.manageSystemACLs. It fails if the release has no bootstrap
+# token, e.g. because ACLs aren't managed by the chart.
+# Example: CONSUL_HTTP_TOKEN=$(acl_bootstrap_token) consul_api /v1/acl/tokens
+acl_bootstrap_token() {
+    local secret="$(name_prefix)-consul-bootstrap-acl-token"
+    if ! kubectl get secret "${secret}" > /dev/null 2>&1; then
+        echo "${secret} does not exist, is global.acls.manageSystemACLs set?" >&2
+        return 1
+    fi
+    kubectl get secret "${secret}" -o jsonpath='{.data.token}' | base64 --decode
+}
+
+# assert_acl_policy fails unless the ACL policy of the given name exists and
+# its rules contain each of the given strings, printing the rules if not.
+# The ACL API is read with CONSUL_HTTP_TOKEN or else the bootstrap token.
+# Example: assert_acl_policy ingress-gateway-ingress-gateway-token 'service "ingress-gateway"'
+assert_acl_policy() {
+    local name=$1
+    shift
+    local CONSUL_HTTP_TOKEN=${CONSUL_HTTP_TOKEN:-$(acl_bootstrap_token)}
+    local rules
+    if ! rules=$(consul_api "/v1/acl/policy/name/${name}" | jq -er '.Rules' 2> /dev/null); then
+        echo "There is no ACL policy named ${name}."
+        return 1
+    fi
+
+    local rule
+    for rule in "$@"; do
+        if [[ "${rules}" != *"${rule}"* ]]; then
+            echo "The rules of ACL policy ${name} don't contain ${rule}:"
+            echo "${rules}"
+            return 1
+        fi
+    done
+}
+
+# assert_token_has_policy fails unless the ACL token whose description
+# contains the given text, e.g. the one server-acl-init created for a
+# gateway, has the ACL policy of the given name, printing the policies it
+# has if not. The ACL API is read as in assert_acl_policy.
+# Example: assert_token_has_policy ingress-gateway-ingress-gateway-token ingress-gateway-ingress-gateway-token
+assert_token_has_policy() {
+    local CONSUL_HTTP_TOKEN=${CONSUL_HTTP_TOKEN:-$(acl_bootstrap_token)}
+    local token
+    token=$(consul_api /v1/acl/tokens | jq -c --arg description "$1" \
+        '[ .[] | select(.Description | contains($description)) ] | first // empty')
+    if [ -z "${token}" ]; then
+        echo "There is no ACL token with a description containing $1."
+        return 1
+    fi
+
+    if ! echo "${token}" | jq -e --arg policy "$2" '.Policies // [] | any(.Name == $policy)' > /dev/null; then
+        echo "The ACL token \"$(echo "${token}" | jq -r .Description)\" doesn't have policy $2, only: $(echo "${token}" | jq -r '[ .Policies[]?.Name ] | join(",")')"
+        return 1
+    fi
+}
+
+# consul_api makes a GET request to the given path of the Consul HTTP API
+# and outputs the response body. By default the request is made from
+# within the first server pod. When TLS is enabled the server container's
+# CONSUL_HTTP_ADDR and CONSUL_CACERT are used so the request goes over
+# HTTPS. If CONSUL_API_LOCAL_PORT is set the request is instead made
+# directly from the test over plain HTTP to that local port, which must
+# have been forwarded to the API with port_forward, and fails clearly if
+# the forward is no longer running. Likewise if CONSUL_API_ADDR is set,
+# e.g. to http://consul.example.com:8500, the request is made directly to
+# that address, such as that of servers outside the cluster. If
+# CONSUL_HTTP_TOKEN is set in the calling environment it is sent as the
+# request's ACL token, and if KUBECONTEXT is set the request is made in
+# that Kubernetes context.
+#
+# Requests time out after CONSUL_API_TIMEOUT seconds (10 by default) and
+# are retried up to CONSUL_API_RETRIES times (3 by default) on connection
+# errors, e.g. while the agent is still starting. Setting
+# CONSUL_API_VERIFY_TLS to false skips verifying the server's certificate.
+# Example: consul_api /v1/catalog/services
+consul_api() {
+    local curl_flags="--max-time ${CONSUL_API_TIMEOUT:-10} --retry ${CONSUL_API_RETRIES:-3} --retry-connrefused --retry-delay 2"
+    if [ "${CONSUL_API_VERIFY_TLS:-true}" = "false" ]; then
+        curl_flags="${curl_flags} --insecure"
+    fi
+
+    if [ -n "${CONSUL_API_LOCAL_PORT}" ]; then
+        if ! port_forward_alive "${CONSUL_API_LOCAL_PORT}"; then
+            echo "The port forward on ${CONSUL_API_LOCAL_PORT} to the Consul API is not running." >&2
+            return 1
+        fi
+        curl -sS ${curl_flags} -H "X-Consul-Token: ${CONSUL_HTTP_TOKEN}" \
+            "http://127.0.0.1:${CONSUL_API_LOCAL_PORT}$1"
+        return
+    fi
+
+    if [ -n "${CONSUL_API_ADDR}" ]; then
+        curl -sS ${curl_flags} -H "X-Consul-Token: ${CONSUL_HTTP_TOKEN}" "${CONSUL_API_ADDR}$1"
+        return
+    fi
+
+    kubectl ${KUBECONTEXT:+--context "${KUBECONTEXT}"} \
+        exec "$(name_prefix)-consul-server-0" -- sh -c \
+        'curl -sS $2 ${CONSUL_CACERT:+--cacert "$CONSUL_CACERT"} -H "X-Consul-Token: $1" "${CONSUL_HTTP_ADDR:-http://127.0.0.1:8500}$0"' \
+        "$1" "${CONSUL_HTTP_TOKEN}" "${curl_flags}"
+}
+
+# consul_api_put makes a PUT request to the given path of the Consul HTTP
+# API from within the first server pod in the same way as consul_api, with
+# the request body read from stdin, and outputs the response body. It fails
+# if the request does.
+# Example: echo '{"Node": "n", "Address": "1.2.3.4"}' | consul_api_put /v1/catalog/register
+consul_api_put() {
+    kubectl ${KUBECONTEXT:+--context "${KUBECONTEXT}"} \
+        exec -i "$(name_prefix)-consul-server-0" -- sh -c \
+        'curl -sSf -X PUT --data-binary @- ${CONSUL_CACERT:+--cacert "$CONSUL_CACERT"} -H "X-Consul-Token: $1" "${CONSUL_HTTP_ADDR:-http://127.0.0.1:8500}$0"' \
+        "$1" "${CONSUL_HTTP_TOKEN}"
+}
+
+# wait_for_leader waits until the servers have elected a leader, as seen
+# through consul_api, so that writes made right after installing don't
+# fail, and fails if they never do.
+wait_for_leader() {
+    for i in $(seq 30); do
+        if [ -n "$(consul_api /v1/status/leader | jq -r '. // empty' 2> /dev/null)" ]; then
+            return
+        fi
+
+        echo "Waiting for a leader..."
+        sleep 2
+    done
+
+    echo "A leader was never elected."
+    return 1
+}
+
+# consul_snapshot_save saves a snapshot of the servers' state to the given
+# local file. CONSUL_HTTP_TOKEN is used if it is set, as it is needed when
+# ACLs are enabled.
+# Example: consul_snapshot_save "${BATS_TMPDIR}/consul.snap"
+consul_snapshot_save() {
+    kubectl exec "$(name_prefix)-consul-server-0" -c consul -- \
+        env ${CONSUL_HTTP_TOKEN:+CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN}"} \
+        sh -c 'consul snapshot save /tmp/consul.snap > /dev/null && cat /tmp/consul.snap' > "$1"
+}
+
+# consul_snapshot_restore restores the servers' state from the given local
+# snapshot file, e.g. one saved with consul_snapshot_save, and waits for a
+# leader to be elected again so that the restored state can be read
+# straight away. CONSUL_HTTP_TOKEN is used if it is set.
+consul_snapshot_restore() {
+    kubectl exec -i "$(name_prefix)-consul-server-0" -c consul -- \
+        env ${CONSUL_HTTP_TOKEN:+CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN}"} \
+        sh -c 'cat > /tmp/consul.snap && consul snapshot restore /tmp/consul.snap' < "$1"
+    wait_for_leader
+}
+
+# retry_with_backoff runs the given command until it succeeds, at most the
+# given number of times. After each failure it waits for the current
+# interval, starting at the given initial one and doubling up to the given
+# maximum, both in seconds, with up to half of it randomized so that
+# retries from concurrent tests spread out. The command's own output shows
+# why each attempt failed. Only the command's exit status counts, so a
+# function passed as the command should end with its assertion.
+# Example: retry_with_backoff 1 8 10 kubectl exec pod -- curl -sSf http://x
+retry_with_backoff() {
+    local interval=$1 max=$2 attempts=$3
+    shift 3
+
+    for i in $(seq ${attempts}); do
+        if "$@"; then
+            return
+        fi
+        if [ ${i} -eq ${attempts} ]; then
+            break
+        fi
+
+        local delay=$(awk -v interval=${interval} -v random=${RANDOM} \
+            'BEGIN { printf "%.2f", interval / 2 + interval / 2 * random / 32767 }')
+        echo "Attempt ${i} of ${attempts} failed, retrying in ${delay}s" >&2
+        sleep ${delay}
+        interval=$(( interval * 2 > max ? max : interval * 2 ))
+    done
+
+    echo "Giving up after ${attempts} attempts" >&2
+    return 1
+}
+
+# wait_for_pods waits until exactly the given number of pods match the
+# given label selector and all of them are running with every container
+# ready, then outputs their names. Unlike `kubectl rollout status` it works
+# the same for Deployments, StatefulSets, DaemonSets and bare pods. An
+# optional third argument is the timeout in seconds, 120 by default, see
+# scaled_timeout. On timeout it fails, printing the phase and container
+# statuses of each pod.
+# Example: wait_for_pods "release=consul,component=server" 3
+wait_for_pods() {
+    local timeout=$(scaled_timeout ${3:-120})
+    local pods
+    for i in $(seq $((timeout / 2))); do
+        pods=$(kubectl_retry get pods -l "$1" -o json)
+        if [ "$(echo "${pods}" | jq --argjson count "$2" '
+            (.items | length) == $count and
+            all(.items[];
+                .status.phase == "Running" and
+                (.status.containerStatuses // [] | length > 0 and all(.ready)))')" = "true" ]; then
+            echo "${pods}" | jq -r '.items[].metadata.name'
+            return
+        fi
+        sleep 2
+    done
+
+    echo "Timed out waiting for $2 ready pods matching $1:" >&2
+    echo "${pods}" | jq -r '.items[] |
+        "\(.metadata.name) \(.status.phase) \([ .status.containerStatuses[]? |
+            "\(.name) ready=\(.ready) \(.state | keys[0]) \(.state[].reason // "")" ] | join(", "))"' >&2
+    return 1
+}
+
+# assert_job_deleted waits until the job of the given name no longer exists
+# and fails, printing the job's status, if it is still there after the
+# optional number of seconds, 60 by default, see scaled_timeout.
+# Example: assert_job_deleted consul-consul-server-acl-init
+assert_job_deleted() {
+    for i in $(seq $(($(scaled_timeout ${2:-60}) / 2))); do
+        if ! kubectl get job "$1" > /dev/null 2>&1; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "Job $1 was never deleted:"
+    kubectl get job "$1" -o jsonpath='{.status}'
+    return 1
+}
+
+# pod_exec runs the given command in the given pod with `kubectl exec`,
+# outputs its stdout, writes its stderr to stderr and returns its exit
+# status, so that tests can tell failures apart, e.g. curl's 7 when the
+# connection is refused from its 52 when the server closes it without a
+# response. -c runs the command in the given container. Unlike `kubectl
+# exec` it gives up on a command that hangs after --timeout seconds, 30 by
+# default, see scaled_timeout, and returns 124 as timeout(1) does. If
+# kubectl itself fails, e.g. because the pod doesn't exist, it returns 255
+# so that can't be mistaken for the command failing.
+# Example: run pod_exec -c static-client "${client}" curl -sS http://localhost:1234; [ "$status" -eq 52 ]
+pod_exec() {
+    local container="" seconds=30
+    while [[ "$1" == -* ]]; do
+        case "$1" in
+            -c) container=$2; shift 2 ;;
+            --timeout) seconds=$2; shift 2 ;;
+            *) echo "pod_exec: unknown option $1" >&2; return 1 ;;
+        esac
+    done
+    local pod=$1
+    shift
+
+    local stderr=$(mktemp) status=0
+    timeout "$(scaled_timeout "${seconds}")" kubectl ${KUBECONTEXT:+--context "${KUBECONTEXT}"} \
+        exec "${pod}" ${container:+-c "${container}"} -- "$@" 2> "${stderr}" || status=$?
+
+    # kubectl reports the command's exit status on stderr, which is only
+    # of use here to tell it from kubectl's own failures.
+    local terminated=$(grep -c '^command terminated with exit code' "${stderr}")
+    grep -v '^command terminated with exit code' "${stderr}" >&2
+    rm -f "${stderr}"
+    if [ ${status} -eq 0 ] || [ ${terminated} -gt 0 ]; then
+        return ${status}
+    fi
+    if [ ${status} -eq 124 ]; then
+        echo "$* in ${pod} timed out after $(scaled_timeout "${seconds}")s" >&2
+        return 124
+    fi
+    echo "kubectl exec into ${pod} failed with exit status ${status}" >&2
+    return 255
+}
+
+# kubectl_jq runs `kubectl get` with the given arguments and outputs the
+# result of the given jq filter applied to the JSON it returns, with
+# strings raw and anything else compact. Unlike piping kubectl into jq, it
+# fails with kubectl's error when kubectl fails, e.g. on a missing object.
+# Example: kubectl_jq '.metadata.annotations' pod static-server-abc123
+kubectl_jq() {
+    local filter=$1
+    shift
+
+    local json
+    if ! json=$(kubectl_retry get "$@" -o json 2> "${BATS_TMPDIR}/kubectl-jq.err"); then
+        echo "kubectl get $* failed: $(cat "${BATS_TMPDIR}/kubectl-jq.err")" >&2
+        return 1
+    fi
+    echo "${json}" | jq -cr "${filter}"
+}
+
+# pod_name outputs the name of the first pod matching the given label
+# selector.
+# Example: pod_name app=static-client
+pod_name() {
+    kubectl_retry get pods -l "$1" -o jsonpath='{.items[0].metadata.name}'
+}
+
+# pod_secrets outputs the sorted, comma-separated names of the secrets the
+# given pod mounts as volumes or reads into environment variables. The
+# automatically mounted service account token is left out.
+# Example: pod_secrets consul-consul-server-0
+pod_secrets() {
+    kubectl get pod "$1" -o json | jq -r '[
+        (.spec.volumes[]?.secret.secretName // empty),
+        (.spec.containers[], .spec.initContainers[]? |
+            (.env[]?.valueFrom.secretKeyRef.name // empty),
+            (.envFrom[]?.secretRef.name // empty))
+    ] | map(select(test("-token-[a-z0-9]{5}$") | not)) | unique | join(",")'
+}
+
+# assert_pod_secrets fails unless the given pod uses exactly the given
+# sorted, comma-separated secrets, e.g. to catch a template change that
+# mounts sensitive material where it shouldn't be.
+# Example: assert_pod_secrets consul-consul-server-0 "consul-consul-ca-cert,consul-consul-server-cert"
+assert_pod_secrets() {
+    local actual=$(pod_secrets $1)
+    if [ "${actual}" != "$2" ]; then
+        echo "$1 uses the secrets \"${actual}\" instead of \"$2\"."
+        return 1
+    fi
+}
+
+# assert_pod_security fails unless every container of the pods matching the
+# given label selector meets each of the given expectations, and prints
+# each container that doesn't with what it has instead. An expectation is
+# a resource request or limit such as limits.memory=200Mi, drop=CAP for a
+# capability the container must drop, which dropping ALL satisfies, or
+# otherwise a securityContext field such as runAsNonRoot=true, which falls
+# back to the pod's securityContext. Quantities are compared as the API
+# server returns them, e.g. 0.5 CPUs as 500m. Only the container of the
+# name given with --container is checked if it is set, -n checks the pods
+# in the given namespace and init containers aren't checked.
+# Example: assert_pod_security "release=$(name_prefix),component=server" --container consul limits.memory=200Mi runAsNonRoot=true
+assert_pod_security() {
+    local selector=$1
+    shift
+    local namespace="" container=""
+    while [[ "$1" == -* ]]; do
+        case "$1" in
+            -n) namespace=$2; shift 2 ;;
+            --container) container=$2; shift 2 ;;
+            *) echo "assert_pod_security: unknown option $1"; return 1 ;;
+        esac
+    done
+
+    local expected=$(printf '%s\n' "$@" | jq -R 'capture("^(?<key>[^=]+)=(?<value>.*)$")' | jq -s .)
+    local containers
+    containers=$(kubectl ${namespace:+-n "${namespace}"} get pods -l "${selector}" -o json |
+        jq -r --argjson expected "${expected}" --arg container "${container}" '
+            .items[] | .metadata.name as $pod | (.spec.securityContext // {}) as $psc |
+            .spec.containers[] | select($container == "" or .name == $container) |
+            . as $c | (.securityContext // {}) as $sc |
+            [ $expected[] | .key as $k | .value as $v |
+              (if $k == "drop" then ($sc.capabilities.drop // [])
+               elif ($k | test("^(limits|requests)\\.")) then ($c.resources // {}) | getpath($k | split("."))
+               elif ($sc | has($k)) then $sc[$k]
+               else $psc[$k] end) as $actual |
+              select(if $k == "drop" then ($actual | any(. == "ALL" or . == $v)) else ($actual | tostring) == $v end | not) |
+              "\($k)=\($actual | if type == "array" then join(",") else tostring end) instead of \($v)" ] |
+            "\($pod)/\($c.name): \(if length == 0 then "ok" else join(", ") end)"') || return 1
+
+    if [ -z "${containers}" ]; then
+        echo "There are no containers${container:+ named ${container}} in pods matching ${selector}."
+        return 1
+    fi
+    if echo "${containers}" | grep -v ': ok$'; then
+        return 1
+    fi
+}
+
+# assert_injected fails unless connect-inject mutated the given pod, i.e.
+# it has the injected status annotation, the consul-connect-inject-init
+# init container and the envoy-sidecar container, and outputs the
+# sidecar's resources as compact JSON so that tests can check what
+# connectInject.sidecarProxy.resources and the pod's annotations set.
+# Example: assert_injected "$(pod_name app=static-server)" | jq -r '.limits.cpu'
+assert_injected() {
+    local pod
+    if ! pod=$(kubectl_jq . pod "$1"); then
+        return 1
+    fi
+
+    local status=$(echo "${pod}" | jq -r '.metadata.annotations["consul.hashicorp.com/connect-inject-status"]')
+    if [ "${status}" != "injected" ]; then
+        echo "$1 has the connect-inject-status annotation \"${status}\" instead of \"injected\"." >&2
+        return 1
+    fi
+    if ! echo "${pod}" | jq -e '.spec.initContainers[]? | select(.name == "consul-connect-inject-init")' > /dev/null; then
+        echo "$1 has no consul-connect-inject-init init container, only: $(echo "${pod}" | jq -r '[.spec.initContainers[]?.name] | join(",")')" >&2
+        return 1
+    fi
+    if ! echo "${pod}" | jq -e '.spec.containers[] | select(.name == "envoy-sidecar")' > /dev/null; then
+        echo "$1 has no envoy-sidecar container, only: $(echo "${pod}" | jq -r '[.spec.containers[].name] | join(",")')" >&2
+        return 1
+    fi
+
+    echo "${pod}" | jq -c '.spec.containers[] | select(.name == "envoy-sidecar") | .resources'
+}
+
+# assert_service_registered waits until the Consul catalog has the given
+# number of instances, 1 by default, of the service of the given name and
+# fails with the instances it does have if it never does. An optional third
+# argument is the datacenter to query, e.g. for federation.
+# Example: assert_service_registered static-server 3 dc2
+assert_service_registered() {
+    assert_service_instances "/v1/catalog/service/$1${3:+?dc=$3}" \
+        '.[] | "\(.Node) \(.ServiceAddress):\(.ServicePort) \(.ServiceTags | join(","))"' \
+        "$1" "${2:-1}" "registered"
+}
+
+# assert_service_healthy is like assert_service_registered but only counts
+# the instances whose health checks are all passing.
+# Example: assert_service_healthy static-server 3
+assert_service_healthy() {
+    assert_service_instances "/v1/health/service/$1?passing${3:+&dc=$3}" \
+        '.[] | "\(.Node.Node) \(.Service.Address):\(.Service.Port)"' \
+        "$1" "${2:-1}" "healthy"
+}
+
+# wait_for_k8s_service waits until the Kubernetes service of the given name
+# exists, in the given namespace or the current one, e.g. one that
+# sync-catalog created for a Consul service, and outputs its type and, for
+# ExternalName services, the name it points at. It fails if the service
+# never appears.
+# Example: wait_for_k8s_service external-server
+wait_for_k8s_service() {
+    local service
+    for i in $(seq $(($(scaled_timeout 60) / 2))); do
+        if service=$(kubectl ${2:+-n "$2"} get service "$1" -o json 2> /dev/null); then
+            echo "${service}" | jq -r '"\(.spec.type) \(.spec.externalName // "")"'
+            return
+        fi
+        sleep 2
+    done
+
+    echo "Service $1 was never created${2:+ in namespace $2}." >&2
+    return 1
+}
+
+# assert_service_instances implements assert_service_registered and
+# assert_service_healthy. Its arguments are the API path, a jq filter
+# describing each instance, the service, the expected count and a word for
+# the failure message.
+assert_service_instances() {
+    local instances
+    for i in $(seq 30); do
+        instances=$(consul_api "$1" | jq -r "$2")
+        if [ "$(echo -n "${instances}" | grep -c '')" -eq "$4" ]; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "Expected $4 $5 instances of $3, found:"
+    echo "${instances}"
+    return 1
+}
+
+# wait_for_health_check waits until the health check with the given ID, or
+# the given name since the checks registered for connect-injected proxies
+# have generated IDs, of the given service reaches the given status:
+# passing, warning or critical. It fails with the status of each of the
+# service's checks if it never does. An optional fourth argument is the
+# datacenter to look in.
+# Example: wait_for_health_check static-server-sidecar-proxy "Proxy Public Listener" passing
+wait_for_health_check() {
+    local checks
+    for i in $(seq 30); do
+        checks=$(consul_api "/v1/health/checks/$1${4:+?dc=$4}")
+        if echo "${checks}" | jq -e --arg id "$2" --arg status "$3" \
+            'any(.[]; (.CheckID == $id or .Name == $id) and .Status == $status)' > /dev/null; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "Expected check $2 of $1 to be $3, the checks are:"
+    echo "${checks}" | jq -r '.[] | "  \(.CheckID) (\(.Name)) on \(.Node): \(.Status)"'
+    return 1
+}
+
+# dig_consul_dns outputs the sorted, comma-separated records of the given
+# type (A by default) that the release's DNS service returns for the given
+# query, e.g. the IPs of a service's instances, or "port target" for SRV
+# records. The query is made with dig from a temporary pod. It skips the
+# current test if the DNS service doesn't exist because dns.enabled is
+# false.
+# Example: dig_consul_dns static-server.service.consul
+dig_consul_dns() {
+    local service="$(name_prefix)-consul-dns"
+    if ! kubectl get service "${service}" > /dev/null 2>&1; then
+        skip "${service} does not exist, is dns.enabled false?"
+    fi
+
+    kubectl run "dig-$(head -c 4 /dev/urandom | od -An -tx1 | tr -d ' \n')" \
+        --rm -i --quiet --restart=Never --image=tutum/dnsutils -- \
+        dig +short "@${service}" "$1" "${2:-A}" |
+        awk -v type="${2:-A}" '{ print (type == "SRV" ? $3 " " $4 : $0) }' |
+        sort | paste -sd, -
+}
+
+# dig_cluster_dns is like dig_consul_dns but queries the cluster's own DNS
+# server, as any pod would, so it only resolves .consul names once the
+# cluster's DNS forwards them to Consul, see configure_dns_stub_domain.
+# Example: dig_cluster_dns static-server.service.consul
+dig_cluster_dns() {
+    kubectl run "dig-$(head -c 4 /dev/urandom | od -An -tx1 | tr -d ' \n')" \
+        --rm -i --quiet --restart=Never --image=tutum/dnsutils -- \
+        dig +short "$1" "${2:-A}" |
+        awk -v type="${2:-A}" '{ print (type == "SRV" ? $3 " " $4 : $0) }' |
+        sort | paste -sd, -
+}
+
+# cluster_dns outputs the DNS server of the cluster whose configuration
+# configure_dns_stub_domain changes: coredns if kube-system has a coredns
+# ConfigMap and kube-dns otherwise.
+cluster_dns() {
+    if kubectl -n kube-system get configmap coredns > /dev/null 2>&1; then
+        echo coredns
+    else
+        echo kube-dns
+    fi
+}
+
+# dns_stub_domain_configured succeeds if the cluster's DNS server, see
+# cluster_dns, already forwards the consul domain somewhere, e.g. to the
+# release of a test running at the same time.
+dns_stub_domain_configured() {
+    if [ "$(cluster_dns)" = "coredns" ]; then
+        kubectl_jq .data.Corefile -n kube-system configmap coredns 2> /dev/null | grep -q '^consul:53 *{'
+    else
+        [ "$(kubectl_jq '.data.stubDomains // "{}" | fromjson | has("consul")' \
+            -n kube-system configmap kube-dns 2> /dev/null)" = "true" ]
+    fi
+}
+
+# configure_dns_stub_domain makes the cluster's DNS server forward the
+# consul domain to the release's DNS service, as documented for dns.enabled,
+# so that every pod can resolve .consul names. CoreDNS gets a server block
+# for consul:53 in its Corefile and kube-dns a stubDomains entry. The
+# previous configuration is restored by helm_delete. There is only one
+# consul domain per cluster, so this refuses to replace one that is
+# already forwarded and tests using it can't run in parallel.
+configure_dns_stub_domain() {
+    if dns_stub_domain_configured; then
+        echo "The cluster's DNS already forwards the consul domain, is another test using it?"
+        return 1
+    fi
+
+    local ip
+    ip=$(kubectl get service "$(name_prefix)-consul-dns" -o jsonpath='{.spec.clusterIP}') || return 1
+    local backup="${BATS_TMPDIR}/dns-config-$(name_prefix).json"
+
+    if [ "$(cluster_dns)" = "coredns" ]; then
+        kubectl -n kube-system get configmap coredns -o json |
+            jq '{data: {Corefile: .data.Corefile}}' > "${backup}" || return 1
+        register_cleanup restore_dns_config coredns "${backup}"
+        local corefile="$(jq -r .data.Corefile "${backup}")
+consul:53 {
+    errors
+    cache 30
+    forward . ${ip}
+}"
+        kubectl -n kube-system patch configmap coredns --type merge \
+            -p "$(jq -n --arg corefile "${corefile}" '{data: {Corefile: $corefile}}')"
+    else
+        if ! kubectl -n kube-system get configmap kube-dns > /dev/null 2>&1; then
+            kubectl -n kube-system create configmap kube-dns || return 1
+            register_cleanup kubectl -n kube-system delete --ignore-not-found configmap kube-dns
+        else
+            kubectl -n kube-system get configmap kube-dns -o json |
+                jq '{data: {stubDomains: .data.stubDomains}}' > "${backup}" || return 1
+            register_cleanup restore_dns_config kube-dns "${backup}"
+        fi
+        kubectl -n kube-system patch configmap kube-dns --type merge \
+            -p "$(jq -n --arg ip "${ip}" '{data: {stubDomains: ({consul: [$ip]} | tojson)}}')"
+    fi
+}
+
+# restore_dns_config restores the data of the given DNS ConfigMap in
+# kube-system from the given file written by configure_dns_stub_domain.
+restore_dns_config() {
+    echo "Restoring the $1 ConfigMap"
+    kubectl -n kube-system patch configmap "$1" --type merge -p "$(cat "$2")" &&
+        rm -f "$2"
+}
+
+# assert_dns_stub_domain fails unless the cluster's DNS configuration, see
+# cluster_dns, forwards the consul domain to the given IP, printing the
+# configuration if it doesn't.
+# Example: assert_dns_stub_domain "$(kubectl get svc consul-consul-dns -o jsonpath='{.spec.clusterIP}')"
+assert_dns_stub_domain() {
+    local dns=$(cluster_dns) config
+    if [ "${dns}" = "coredns" ]; then
+        config=$(kubectl_jq .data.Corefile -n kube-system configmap coredns) || return 1
+        if echo "${config}" | awk '/^consul:53 *\{/ { block = 1 } block && /^\}/ { block = 0 } block' |
+                grep -qE "^ *forward \. ([0-9.: ]+ )?$1( |:53|$)"; then
+            return
+        fi
+    else
+        config=$(kubectl_jq '.data.stubDomains // "{}"' -n kube-system configmap kube-dns) || return 1
+        if echo "${config}" | jq -e --arg ip "$1" '.consul // [] | any(. == $ip or . == ($ip + ":53"))' > /dev/null; then
+            return
+        fi
+    fi
+
+    echo "${dns} doesn't forward the consul domain to $1, its configuration is:"
+    echo "${config}"
+    return 1
+}
+
+# gateway_external_address waits until the LoadBalancer service of the
+# given name has been assigned an external IP or hostname and outputs it
+# joined with the given port, ready to dial from outside the cluster. An
+# optional third argument is the timeout in seconds, 300 by default, see
+# scaled_timeout. On timeout it fails, printing the service's status.
+# Example: gateway_external_address consul-consul-ingress-gateway 8080
+gateway_external_address() {
+    local host=""
+    for i in $(seq $(($(scaled_timeout ${3:-300}) / 5))); do
+        host=$(kubectl_jq '.status.loadBalancer.ingress[0] // {} | .ip // .hostname // empty' service "$1")
+        if [ -n "${host}" ]; then
+            echo "${host}:$2"
+            return
+        fi
+        sleep 5
+    done
+
+    echo "Service $1 was never assigned an external address, its status is:" >&2
+    kubectl_jq '.status' service "$1" >&2
+    return 1
+}
+
+# envoy_admin outputs the response of the Envoy admin API at the given path
+# in the given pod. The admin API is reached on ENVOY_ADMIN_ADDRESS
+# (127.0.0.1 by default) and ENVOY_ADMIN_PORT (19000 by default) in the
+# ENVOY_CONTAINER container (envoy-sidecar by default), so gateways can be
+# queried by setting ENVOY_CONTAINER, e.g. to ingress-gateway.
+# Example: envoy_admin static-client-abc123 /ready
+envoy_admin() {
+    kubectl exec "$1" -c "${ENVOY_CONTAINER:-envoy-sidecar}" -- \
+        wget -qO- "http://${ENVOY_ADMIN_ADDRESS:-127.0.0.1}:${ENVOY_ADMIN_PORT:-19000}$2"
+}
+
+# envoy_config_dump outputs the full configuration of the Envoy in the
+# given pod as JSON, as reported by the admin API's /config_dump. See
+# envoy_listeners, envoy_clusters and envoy_routes for the parts of it
+# that tests usually assert on.
+# Example: envoy_config_dump static-client-abc123 > "${BATS_TMPDIR}/config_dump.json"
+envoy_config_dump() {
+    envoy_admin "$1" /config_dump
+}
+
+# envoy_listeners outputs a line per listener the Envoy in the given pod
+# has been configured with by Consul, holding its name and the address and
+# port it listens on, e.g. "static-server:127.0.0.1:1234 127.0.0.1:1234".
+envoy_listeners() {
+    envoy_config_dump "$1" | jq -r '
+        .configs[] | .dynamic_listeners[]? | .active_state.listener |
+        "\(.name) \(.address.socket_address.address):\(.address.socket_address.port_value)"'
+}
+
+# wait_for_ingress_listener waits until the ingress gateway in the given pod
+# has a listener on the given port for the given protocol, tcp or http, as
+# set in its ingress-gateway config entry, so that requests through the
+# gateway aren't made before it has picked up the config entry. It fails,
+# printing the gateway's listeners, if it never does. The gateway's admin
+# API is reached as in envoy_admin, in the ingress-gateway container unless
+# ENVOY_CONTAINER is set.
+# Example: wait_for_ingress_listener "$(pod_name component=ingress-gateway)" 8080 tcp
+wait_for_ingress_listener() {
+    local filter=envoy.tcp_proxy
+    if [ "$3" = "http" ]; then
+        filter=envoy.http_connection_manager
+    fi
+
+    for i in $(seq $(($(scaled_timeout 60) / 2))); do
+        if ENVOY_CONTAINER=${ENVOY_CONTAINER:-ingress-gateway} envoy_config_dump "$1" 2> /dev/null |
+            jq -e --argjson port "$2" --arg filter "${filter}" '
+                [ .configs[] | .dynamic_listeners[]? | .active_state.listener |
+                    select(.address.socket_address.port_value == $port) |
+                    .filter_chains[].filters[] | select(.name == $filter) ] | length > 0' > /dev/null; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "The ingress gateway $1 never listened on port $2 for $3, its listeners are:"
+    ENVOY_CONTAINER=${ENVOY_CONTAINER:-ingress-gateway} envoy_listeners "$1"
+    return 1
+}
+
+# envoy_clusters outputs the name of each cluster the Envoy in the given pod
+# has been configured with by Consul, e.g. the upstream
+# static-server.default.dc1.internal.<trust domain>.consul.
+envoy_clusters() {
+    envoy_config_dump "$1" | jq -r '
+        .configs[] | .dynamic_active_clusters[]? | .cluster.name'
+}
+
+# envoy_routes outputs a line per HTTP route the Envoy in the given pod has
+# been configured with by Consul, holding the name of the route
+# configuration, which is the upstream's name, what the route matches, the
+# cluster it routes to and its timeout, or "-" if it has none, e.g.
+# "static-server prefix:/admin static-server-admin.default.dc1.internal.<trust domain>.consul -".
+# Weighted clusters are joined with "+".
+# Example: envoy_routes static-client-abc123 | grep '^static-server prefix:/admin '
+envoy_routes() {
+    envoy_config_dump "$1" | jq -r '
+        .configs[] | .dynamic_route_configs[]? | .route_config as $config |
+        $config.virtual_hosts[].routes[] |
+        "\($config.name) " +
+        (if .match.prefix then "prefix:\(.match.prefix)"
+         elif .match.path then "path:\(.match.path)"
+         else "regex:\(.match.safe_regex.regex // .match.regex)" end) + " " +
+        (.route.cluster // ([ .route.weighted_clusters.clusters[]?.name ] | join("+"))) + " " +
+        (.route.timeout // "-")'
+}
+
+# leaf_cert_serial outputs the serial number of the leaf certificate the
+# Envoy in the given pod is serving with, as reported by the admin API. It
+# changes whenever the certificate is reissued, e.g. after rotate_connect_ca.
+# Example: leaf_cert_serial static-client-abc123
+leaf_cert_serial() {
+    envoy_admin "$1" /certs |
+        jq -r '[ .certificates[].cert_chain[]?.serial_number ] | unique | join(",")'
+}
+
+# rotate_connect_ca rotates the Connect CA to a new root by setting its
+# configuration without a private key, which makes the built-in provider
+# generate a new one, and every leaf certificate is then reissued. The
+# configuration is the CA's current one unless a JSON file with another is
+# given.
+# Example: rotate_connect_ca "${BATS_TEST_DIRNAME}/fixtures/connect-ca-config.json"
+rotate_connect_ca() {
+    local config="${BATS_TMPDIR}/connect-ca-config.json"
+    if [ -n "$1" ]; then
+        cp "$1" "${config}"
+    else
+        consul_api /v1/connect/ca/configuration |
+            jq '{Provider, Config: (.Config | del(.PrivateKey, .RootCert))}' > "${config}"
+    fi
+
+    kubectl exec -i "$(name_prefix)-consul-server-0" -c consul -- \
+        env ${CONSUL_HTTP_TOKEN:+CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN}"} sh -c \
+        'cat > /tmp/ca-config.json && consul connect ca set-config -config-file /tmp/ca-config.json' \
+        < "${config}"
+}
+
+# start_request_loop starts curling the given URL from the given container
+# of the given pod once a second in the background, recording every
+# request that fails, until stop_request_loop is called. This shows whether
+# traffic was interrupted at any point during e.g. a CA rotation rather
+# than only whether it works afterwards.
+# Example: start_request_loop static-client-abc123 static-client http://localhost:1234
+start_request_loop() {
+    start_probe_loop "$1" kubectl exec "$1" -c "$2" -- curl -sSf --max-time 5 "$3"
+}
+
+# start_probe_loop is like start_request_loop but runs the given probe
+# command, e.g. a function of the test, once a second instead of curl. The
+# first argument names the loop for stop_request_loop.
+# Example: start_probe_loop gateway curl -sSf --max-time 5 "http://${address}"
+start_probe_loop() {
+    local name=$1
+    shift
+    local log="${BATS_TMPDIR}/requests-$(name_prefix)-${name}.log"
+    : > "${log}"
+    (
+        while true; do
+            if "$@" > /dev/null 2>&1; then
+                echo "ok"
+            else
+                echo "failed at $(date +%H:%M:%S)"
+            fi >> "${log}"
+            sleep 1
+        done
+    ) 3>&- &
+    echo $! > "${BATS_TMPDIR}/requests-$(name_prefix)-${name}.pid"
+    register_cleanup stop_request_loop "${name}"
+}
+
+# stop_request_loop stops the requests started by start_request_loop from
+# the given pod, or by start_probe_loop under the given name, and fails if
+# more of them failed than the optional number allowed, 0 by default, or
+# if none were made.
+# Example: stop_request_loop static-client-abc123
+stop_request_loop() {
+    local pid="${BATS_TMPDIR}/requests-$(name_prefix)-$1.pid"
+    local log="${BATS_TMPDIR}/requests-$(name_prefix)-$1.log"
+    if [ ! -f "${pid}" ]; then
+        return
+    fi
+    kill "$(cat "${pid}")" 2> /dev/null || true
+    rm -f "${pid}"
+
+    local total=$(grep -c '' "${log}")
+    local failures=$(grep '^failed' "${log}")
+    local failed=$(echo -n "${failures}" | grep -c '')
+    rm -f "${log}"
+    echo "${total} requests from $1, ${failed} failed"
+    if [ "${failed}" -gt "${2:-0}" ]; then
+        echo "${failures}"
+        return 1
+    fi
+    [ "${total}" -gt 0 ]
+}
+
+# delete_pod_and_monitor deletes the given pod while running the given
+# probe command once a second, from a few seconds before the deletion
+# until a few seconds after the pod is gone, and fails if more probes
+# failed than the given number allowed. This shows whether connections are
+# dropped while a pod behind a service, e.g. a connect-injected one, is
+# terminated.
+# Example: delete_pod_and_monitor static-server-abc123 0 kubectl exec static-client-def456 -c static-client -- curl -sSf --max-time 5 http://localhost:1234
+delete_pod_and_monitor() {
+    local pod=$1 max_failures=$2
+    shift 2
+
+    start_probe_loop "delete-${pod}" "$@"
+    sleep 3
+    kubectl delete pod "${pod}" --wait || return 1
+    sleep 5
+    stop_request_loop "delete-${pod}" "${max_failures}"
+}
+
+# load_test makes requests to the given URL from the given container of
+# the given pod with the given number of concurrent curl loops for the given
+# number of seconds, printing progress and a summary to stderr. It outputs
+# the number of requests, how many of them failed, i.e. didn't get a 2xx
+# response, and the 50th, 90th and 99th percentile latencies in
+# milliseconds, separated by spaces. The container must have curl.
+# Example: read requests failures p50 p90 p99 < <(load_test static-client-abc123 static-client http://localhost:1234 10 30)
+load_test() {
+    local pod=$1 container=$2 url=$3 concurrency=$4 duration=$5
+    local results="${BATS_TMPDIR}/load-test-$(name_prefix)-${pod}"
+
+    echo "Making requests to ${url} from ${pod} with ${concurrency} loops for ${duration}s" >&2
+    kubectl exec "${pod}" -c "${container}" -- sh -c '
+        end=$(( $(date +%s) + $3 ))
+        for i in $(seq $2); do
+            while [ "$(date +%s)" -lt "${end}" ]; do
+                curl -s -o /dev/null --max-time 5 -w "%{http_code} %{time_total}\n" "$1"
+            done &
+        done
+        wait' -- "${url}" "${concurrency}" "${duration}" |
+        awk '{ print } NR % 100 == 0 { printf "%d requests so far\n", NR > "/dev/stderr" }' > "${results}"
+
+    local summary=$(awk '{ print $2 * 1000, ($1 ~ /^2/ ? 0 : 1) }' "${results}" | sort -n | awk '
+        { latency[NR] = $1; failures += $2 }
+        function percentile(p) { i = int(NR * p / 100 + 0.5); if (i < 1) i = 1; return latency[i] }
+        END { if (NR == 0) { print "0 0 0 0 0"; exit }
+              printf "%d %d %d %d %d\n", NR, failures, percentile(50), percentile(90), percentile(99) }')
+    rm -f "${results}"
+
+    local requests failures p50 p90 p99
+    read -r requests failures p50 p90 p99 <<< "${summary}"
+    echo "${requests} requests, ${failures} failed, latency p50 ${p50}ms, p90 ${p90}ms, p99 ${p99}ms" >&2
+    echo "${summary}"
+}
+
+# wait_for_envoy_ready waits until the Envoy admin API in the given pod
+# reports that Envoy is live, i.e. it has received its initial
+# configuration from Consul, and fails if it never does.
+# Example: wait_for_envoy_ready static-client-abc123
+wait_for_envoy_ready() {
+    for i in $(seq 30); do
+        if [ "$(envoy_admin $1 /ready 2> /dev/null)" = "LIVE" ]; then
+            echo "Envoy in $1 is ready"
+            return
+        fi
+
+        echo "Waiting for Envoy in $1 to be ready..."
+        sleep 2
+    done
+
+    echo "Envoy in $1 never became ready."
+    return 1
+}
+
+# assert_envoy_upstream_healthy fails unless the Envoy in the given pod has
+# a cluster for the upstream service of the given name with at least one
+# healthy endpoint, printing which of the two is missing.
+# Example: assert_envoy_upstream_healthy static-client-abc123 static-server
+assert_envoy_upstream_healthy() {
+    local clusters=$(envoy_admin $1 "/clusters?format=json" |
+        jq --arg service "$2" '[
+            .cluster_statuses[] | select(.name | startswith($service + "."))
+        ]')
+    if [ "$(echo "${clusters}" | jq 'length')" -eq 0 ]; then
+        echo "no upstream cluster for $2 in $1"
+        return 1
+    fi
+
+    local healthy=$(echo "${clusters}" | jq '[
+        .[].host_statuses[]? |
+        select(.health_status.eds_health_status == "HEALTHY")
+    ] | length')
+    if [ "${healthy}" -eq 0 ]; then
+        echo "no healthy endpoints for upstream $2 in $1"
+        return 1
+    fi
+}
+
+# envoy_endpoints outputs the sorted, comma-separated IPs of the endpoints
+# Envoy has for the upstream service of the given name, as reported by the
+# admin API of the given pod's sidecar.
+# Example: envoy_endpoints static-client-abc123 static-server
+envoy_endpoints() {
+    envoy_admin "$1" "/clusters?format=json" |
+        jq -r --arg service "$2" '[
+            .cluster_statuses[] |
+            select(.name | startswith($service + ".")) |
+            .host_statuses[]?.address.socket_address.address
+        ] | sort | join(",")'
+}
+
+# catalog_endpoints outputs the sorted, comma-separated IPs of the healthy
+# Connect-capable instances of the given service in the Consul catalog.
+catalog_endpoints() {
+    consul_api "/v1/health/connect/$1?passing" |
+        jq -r '[ .[].Service.Address ] | sort | join(",")'
+}
+
+# wait_for_envoy_endpoints waits until the endpoints the given pod's Envoy
+# has for the given upstream service match the healthy instances in the
+# Consul catalog, and fails with both sets if they never converge. An
+# optional third argument is the number of endpoints to wait for.
+# Example: wait_for_envoy_endpoints static-client-abc123 static-server 3
+wait_for_envoy_endpoints() {
+    local envoy catalog
+    for i in $(seq 30); do
+        envoy=$(envoy_endpoints $1 $2)
+        catalog=$(catalog_endpoints $2)
+        if [ -n "${catalog}" ] && [ "${envoy}" = "${catalog}" ] &&
+            { [ -z "$3" ] || [ "$(echo "${envoy}" | tr ',' '\n' | wc -l)" -eq "$3" ]; }; then
+            echo "Envoy endpoints for $2 match the catalog: ${envoy}"
+            return
+        fi
+
+        echo "Waiting for Envoy endpoints for $2 (${envoy}) to match the catalog (${catalog})..."
+        sleep 2
+    done
+
+    echo "Envoy endpoints for $2 (${envoy}) never matched the catalog (${catalog})."
+    return 1
+}
+
+# agent_config outputs the result of the given jq filter applied to the
+# runtime configuration of the first server's agent, i.e. the DebugConfig
+# of /v1/agent/self, so that tests can check that chart values end up in
+# the agent's effective configuration. Secrets such as the gossip key are
+# reported as "hidden". The request is made with consul_api, so set
+# CONSUL_HTTP_TOKEN when the release has ACLs.
+# Example: agent_config .Datacenter
+agent_config() {
+    consul_api /v1/agent/self | jq -cr ".DebugConfig | $1"
+}
+
+# assert_gossip_encrypted fails unless gossip is encrypted, i.e. every
+# server reports encrypted LAN and WAN gossip and each of the keyring's
+# gossip pools has exactly one key, which every member uses. If given, that
+# key must be the given one, e.g. the one in the gossipEncryption secret.
+# Listing the keyring needs operator:read, so with ACLs the bootstrap token
+# is used unless CONSUL_HTTP_TOKEN is set.
+# Example: assert_gossip_encrypted "$(kubectl get secret consul-gossip-encryption-key -o jsonpath='{.data.key}' | base64 --decode)"
+assert_gossip_encrypted() {
+    local CONSUL_HTTP_TOKEN=${CONSUL_HTTP_TOKEN:-$(acl_bootstrap_token 2> /dev/null)}
+
+    local server encrypted
+    for server in $(kubectl get pods -l "release=$(name_prefix),component=server" -o name); do
+        encrypted=$(kubectl exec "${server#pod/}" -c consul -- \
+            env ${CONSUL_HTTP_TOKEN:+CONSUL_HTTP_TOKEN="${CONSUL_HTTP_TOKEN}"} consul info |
+            awk '/^serf_(lan|wan):/ { pool = $1 } $1 == "encrypted" { print pool " " $3 }' | paste -sd, -)
+        if [ "${encrypted}" != "serf_lan: true,serf_wan: true" ]; then
+            echo "${server#pod/} doesn't encrypt its gossip: ${encrypted}"
+            return 1
+        fi
+    done
+
+    local keyring
+    keyring=$(consul_api /v1/operator/keyring) || return 1
+    if ! echo "${keyring}" | jq -e --arg key "$1" 'length > 0 and all(.[]; . as $pool |
+            (.Keys | length) == 1 and
+            all(.Keys[]; . == $pool.NumNodes) and
+            ($key == "" or .Keys[$key] != null))' > /dev/null 2>&1; then
+        echo "The gossip keyring doesn't have a single key in use by every member${1:+ matching the given key}:"
+        echo "${keyring}" | jq -r '.[]? | "  \(if .WAN then "WAN" else "LAN \(.Datacenter)" end): \(.NumNodes) members, keys \(.Keys | to_entries | map("\(.key[0:6])... used by \(.value)") | join(", "))"' 2> /dev/null ||
+            echo "${keyring}"
+        return 1
+    fi
+}
+
+# client_known_servers outputs the number of servers the client agent in
+# the given pod knows about and forwards its RPCs to.
+# Example: client_known_servers consul-consul-abc12
+client_known_servers() {
+    kubectl exec "$1" -- curl -sS http://127.0.0.1:8500/v1/agent/self |
+        jq -r '.Stats.consul.known_servers'
+}
+
+# assert_client_connected fails unless the client agent in the given pod
+# knows about the given number of servers (all replicas by default).
+# Example: assert_client_connected consul-consul-abc12 3
+assert_client_connected() {
+    local expected=${2:-$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.spec.replicas}')}
+    local known
+    for i in $(seq 30); do
+        known=$(client_known_servers $1)
+        if [ "${known}" = "${expected}" ]; then
+            echo "$1 knows about ${known} servers."
+            return
+        fi
+
+        echo "Waiting for $1 to know about ${expected} servers (${known})..."
+        sleep 2
+    done
+
+    echo "$1 never knew about ${expected} servers (${known})."
+    return 1
+}
+
+# wait_for_raft_healthy waits until autopilot reports the servers as
+# healthy with the given number of voters and a single leader, e.g. after
+# scaling or rolling the servers, and fails if they never are, printing
+# each server's state as autopilot sees it. An optional second argument is
+# the timeout in seconds, 120 by default, see scaled_timeout.
+# Example: wait_for_raft_healthy 3
+wait_for_raft_healthy() {
+    local health
+    for i in $(seq $(($(scaled_timeout ${2:-120}) / 2))); do
+        health=$(consul_api /v1/operator/autopilot/health)
+        if echo "${health}" | jq -e --argjson voters "$1" '
+            .Healthy and
+            ([ .Servers[] | select(.Voter) ] | length) == $voters and
+            ([ .Servers[] | select(.Leader) ] | length) == 1' > /dev/null 2>&1; then
+            echo "Raft is healthy with $1 voters"
+            return
+        fi
+        sleep 2
+    done
+
+    echo "Raft never became healthy with $1 voters, autopilot reports:"
+    echo "${health}" | jq -r '"  failure tolerance \(.FailureTolerance)", (.Servers[]? |
+        "  \(.Name): healthy=\(.Healthy) voter=\(.Voter) leader=\(.Leader) serf=\(.SerfStatus) last contact=\(.LastContact)")' 2> /dev/null ||
+        echo "${health}"
+    return 1
+}
+
+# scale_servers upgrades the release to the given number of servers, with
+# any other arguments passed on to helm_upgrade, e.g. the values the
+# release was installed with, and waits until every server is ready and
+# raft is healthy with them all as voters. An even number of servers
+# tolerates no more failures than one server fewer, so it is allowed but
+# warned about.
+# Example: scale_servers 5 --set 'connectInject.enabled=true'
+scale_servers() {
+    local replicas=$1
+    shift
+    if [ $((replicas % 2)) -eq 0 ]; then
+        echo "Warning: ${replicas} servers tolerate no more failures than $((replicas - 1))."
+    fi
+
+    # Fewer servers than bootstrapExpect could never bootstrap a new cluster.
+    local bootstrap_expect=$((replicas < 3 ? replicas : 3))
+    helm_upgrade \
+        --set "server.replicas=${replicas}" \
+        --set "server.bootstrapExpect=${bootstrap_expect}" \
+        "$@" || return 1
+    kubectl rollout status --timeout="$(scaled_timeout 300)s" "statefulset/$(name_prefix)-consul-server" &&
+        wait_for_raft_healthy ${replicas}
+}
+
+# server_leader outputs the name of the server pod that is the raft leader.
+server_leader() {
+    kubectl exec "$(name_prefix)-consul-server-0" -- consul operator raft list-peers |
+        awk '$4 == "leader" { print $1 }'
+}
+
+# scrape_metrics fetches the Prometheus metrics served at the given port
+# and path from within the given container of the given pod and outputs a
+# line per sample holding the series, i.e. the metric's name with its
+# labels, and its value, without comments and timestamps. Responses that
+# are gzipped are decompressed. The container must have wget, which the
+# Consul and Envoy images do.
+# Example: scrape_metrics static-client-abc123 envoy-sidecar 19000 /stats/prometheus
+scrape_metrics() {
+    local file="${BATS_TMPDIR}/metrics-$1-$2"
+    kubectl exec "$1" -c "$2" -- wget -qO- "http://127.0.0.1:$3$4" > "${file}" || return 1
+
+    if [ "$(head -c 2 "${file}" | od -An -tx1 | tr -d ' \n')" = "1f8b" ]; then
+        gunzip -c "${file}"
+    else
+        cat "${file}"
+    fi | awk '!/^#/ && NF >= 2 { print $1, $2 }'
+    rm -f "${file}"
+}
+
+# metric_value reads the output of scrape_metrics on stdin and outputs the
+# sum of the values of the samples of the given metric, optionally only of
+# those whose labels contain the given text. It fails if there are no such
+# samples.
+# Example: scrape_metrics ... | metric_value envoy_cluster_upstream_rq_total static-server
+metric_value() {
+    awk -v name="$1" -v labels="$2" '
+        { series = $1; metric = series; sub(/\{.*/, "", metric) }
+        metric == name && index(series, labels) { sum += $2; found = 1 }
+        END { if (!found) exit 1; printf "%.15g\n", sum }'
+}
+
+# assert_server_metrics fails unless the Prometheus metrics of the server
+# in the given pod include every one of the given metrics. Servers only
+# serve Prometheus metrics when telemetry.prometheus_retention_time is set.
+# Example: assert_server_metrics consul-consul-server-0 consul_autopilot_healthy
+assert_server_metrics() {
+    local pod=$1
+    shift
+
+    local metrics
+    metrics=$(scrape_metrics "${pod}" consul 8500 "/v1/agent/metrics?format=prometheus") || return 1
+    local missing=""
+    for metric in "$@"; do
+        if ! echo "${metrics}" | metric_value "${metric}" > /dev/null; then
+            missing="${missing} ${metric}"
+        fi
+    done
+
+    if [ -n "${missing}" ]; then
+        echo "${pod} is missing the metrics:${missing}"
+        return 1
+    fi
+}
+
+# xds_streams outputs the number of proxies streaming xDS configuration
+# from the client agents of this release, counted as established
+# connections to the agents' gRPC port. Proxies get their configuration
+# from the agent on their node rather than from the servers directly.
+xds_streams() {
+    local total=0 count
+    for pod in $(kubectl get pods -l "release=$(name_prefix),component=client" -o jsonpath='{.items[*].metadata.name}'); do
+        count=$(kubectl exec ${pod} -- netstat -tn | awk '$4 ~ /:8502$/ && $6 == "ESTABLISHED"' | wc -l)
+        total=$((total + count))
+    done
+    echo ${total}
+}
+
+# wait_for_xds_streams waits until the number of xDS streams on the client
+# agents equals the given number of proxies, and fails if it never does,
+# e.g. because streams of deleted proxies were leaked.
+# Example: wait_for_xds_streams 3
+wait_for_xds_streams() {
+    local streams
+    for i in $(seq 30); do
+        streams=$(xds_streams)
+        if [ "${streams}" -eq "$1" ]; then
+            echo "The client agents have $1 xDS streams."
+            return
+        fi
+
+        echo "Waiting for ${streams} xDS streams to become $1..."
+        sleep 2
+    done
+
+    echo "The client agents have ${streams} xDS streams instead of $1."
+    return 1
+}
+
+# config_entry_field outputs a field of a config entry given the entry's
+# kind and name and a dotted path to the field. Numeric path segments index
+# into lists.
+# Example: config_entry_field ingress-gateway my-gateway Listeners.0.Port
+config_entry_field() {
+    consul_api "/v1/config/$1/$2" |
+        jq -r --arg path "$3" 'getpath($path | split(".") | map(tonumber? // .))'
+}
+
+# consul_port_accepts outputs "true" if the first server pod serves the
+# Consul HTTP API with the given scheme on the given port and "false"
+# otherwise, e.g. when the port is closed.
+# Example: consul_port_accepts https 8501
+consul_port_accepts() {
+    local ca_flag=""
+    if [ "$1" = "https" ]; then
+        ca_flag="--cacert /consul/tls/ca/tls.crt"
+    fi
+
+    if kubectl exec "$(name_prefix)-consul-server-0" -- \
+        curl -sSf ${ca_flag} "$1://127.0.0.1:$2/v1/status/leader" > /dev/null; then
+        echo "true"
+    else
+        echo "false"
+    fi
+}
+
+# ca_cert_fingerprint outputs the SHA-256 fingerprint of the Consul CA
+# certificate the chart generated when TLS is enabled. Comparing it before
+# and after an upgrade shows whether the CA was regenerated, which would
+# break TLS between agents still using certificates from the old one.
+ca_cert_fingerprint() {
+    kubectl get secret "$(name_prefix)-consul-ca-cert" -o jsonpath='{.data.tls\.crt}' |
+        base64 --decode | openssl x509 -noout -fingerprint -sha256
+}
+
+# webhook_ca_bundle outputs the PEM encoded CA bundle the API server uses
+# to verify the connect injector's webhook.
+webhook_ca_bundle() {
+    kubectl get mutatingwebhookconfiguration "$(name_prefix)-consul-connect-injector-cfg" \
+        -o jsonpath='{.webhooks[0].clientConfig.caBundle}' | base64 --decode
+}
+
+# webhook_namespace_selector outputs the namespaceSelector of the connect
+# injector's webhook as compact JSON, or null if it has none.
+webhook_namespace_selector() {
+    kubectl get mutatingwebhookconfiguration "$(name_prefix)-consul-connect-injector-cfg" -o json |
+        jq -c '.webhooks[0].namespaceSelector'
+}
+
+# assert_webhook_namespace_selector fails unless the connect injector's
+# webhook has the given namespaceSelector, given as JSON.
+# Example: assert_webhook_namespace_selector '{"matchLabels": {"connect-inject": "enabled"}}'
+assert_webhook_namespace_selector() {
+    local actual=$(webhook_namespace_selector)
+    if [ "${actual}" != "$(echo "$1" | jq -c .)" ]; then
+        echo "The webhook's namespaceSelector is ${actual} instead of $1."
+        return 1
+    fi
+}
+
+# webhook_serving_cert outputs the PEM encoded certificate the connect
+# injector serves its webhook with, whether it was generated by the
+# injector or provided through connectInject.certs.secretName.
+webhook_serving_cert() {
+    port_forward "svc/$(name_prefix)-consul-connect-injector-svc" 18443 443 > /dev/null
+    openssl s_client -connect 127.0.0.1:18443 < /dev/null 2> /dev/null | openssl x509
+    stop_port_forward 18443
+}
+
+# assert_webhook_cert_valid fails unless the connect injector's serving
+# certificate is signed by the webhook's CA bundle and is valid for at
+# least the given number of seconds (one day by default). An expired
+# webhook certificate blocks the creation of every pod the webhook
+# matches, so this is worth checking after any change to it.
+# Example: assert_webhook_cert_valid 604800
+assert_webhook_cert_valid() {
+    local dir=$(mktemp -d)
+    webhook_ca_bundle > "${dir}/ca.pem"
+    webhook_serving_cert > "${dir}/cert.pem"
+
+    if ! openssl verify -CAfile "${dir}/ca.pem" "${dir}/cert.pem"; then
+        echo "The webhook certificate is not signed by the webhook's CA bundle."
+        rm -rf "${dir}"
+        return 1
+    fi
+
+    if ! openssl x509 -in "${dir}/cert.pem" -noout -checkend "${1:-86400}"; then
+        echo "The webhook certificate expires within ${1:-86400} seconds:"
+        openssl x509 -in "${dir}/cert.pem" -noout -enddate
+        rm -rf "${dir}"
+        return 1
+    fi
+
+    rm -rf "${dir}"
+}
+
+# consul_rpc_accepts outputs "true" if the servers accept RPC from a client
+# agent and "false" if they refuse it. The agent is started temporarily
+# inside the first server pod by fixtures/rpc-check.sh and presents the
+# server's certificate as its client certificate if the argument is
+# "with-cert" and none otherwise.
+# Example: consul_rpc_accepts without-cert
+consul_rpc_accepts() {
+    local code=$(kubectl exec -i "$(name_prefix)-consul-server-0" -- sh -s -- "$1" \
+        < "${BATS_TEST_DIRNAME}/fixtures/rpc-check.sh")
+
+    # A missing key means the read reached the servers.
+    if [ "${code}" = "404" ]; then
+        echo "true"
+    else
+        echo "false"
+    fi
+}
+
+# assert_logs_do_not_contain fails if the logs of any pod of this release
+# matching the given label selector contain any of the given patterns. It
+# surfaces errors that are logged but don't fail readiness.
+# Example: assert_logs_do_not_contain component=server "raft: failed to"
+assert_logs_do_not_contain() {
+    local selector=$1
+    shift
+
+    local found=""
+    for pod in $(kubectl get pods -l "release=$(name_prefix),${selector}" -o jsonpath='{.items[*].metadata.name}'); do
+        local logs=$(kubectl logs ${pod} --all-containers)
+        for pattern in "$@"; do
+            if echo "${logs}" | grep -F "${pattern}"; then
+                found="${found}\n${pod}: ${pattern}"
+            fi
+        done
+    done
+
+    if [ -n "${found}" ]; then
+        echo -e "Found unexpected log lines:${found}"
+        return 1
+    fi
+}
+
+# helm_install_enterprise installs the chart like helm_install but with the
+# Consul Enterprise image from CONSUL_ENT_IMAGE, skipping the current test
+# if it isn't set. If CONSUL_ENT_LICENSE_PATH is set to a license file, the
+# license is stored in a secret and applied through
+# server.enterpriseLicense. The secret is named after the release so
+# helm_delete deletes it. Any arguments are passed through to helm_install.
+helm_install_enterprise() {
+    skip_unless_enterprise
+
+    local license_args=()
+    if [ -n "${CONSUL_ENT_LICENSE_PATH}" ]; then
+        if [ ! -f "${CONSUL_ENT_LICENSE_PATH}" ]; then
+            echo "CONSUL_ENT_LICENSE_PATH ${CONSUL_ENT_LICENSE_PATH} does not exist"
+            return 1
+        fi
+
+        use_test_namespace
+        local secret="$(name_prefix)-consul-ent-license"
+        kubectl create secret generic "${secret}" --from-file=key="${CONSUL_ENT_LICENSE_PATH}" || return 1
+        license_args=(
+            --set "server.enterpriseLicense.secretName=${secret}"
+            --set "server.enterpriseLicense.secretKey=key"
+        )
+    fi
+
+    helm_install --set "global.image=${CONSUL_ENT_IMAGE}" "${license_args[@]}" "$@"
+}
+
+# assert_audit_log_contains waits until the Consul Enterprise audit log in
+# the given server pod has an event matching the given jq condition and
+# fails, printing the log's last events, if it never does. The log is read
+# from AUDIT_LOG_PATH, /consul/data/audit.json by default as in
+# fixtures/audit-log-values.yaml, and parsed as JSON lines so that the
+# condition can match on specific fields.
+# Example: assert_audit_log_contains consul-consul-server-0 '.payload.request.endpoint == "/v1/acl/token" and .payload.request.operation == "PUT"'
+assert_audit_log_contains() {
+    local events
+    for i in $(seq $(($(scaled_timeout 60) / 2))); do
+        events=$(kubectl exec "$1" -c consul -- cat "${AUDIT_LOG_PATH:-/consul/data/audit.json}")
+        if echo "${events}" | jq -se "any(.[]; $2)" > /dev/null; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "The audit log of $1 has no event where $2, its last events are:"
+    echo "${events}" | tail -n 5
+    return 1
+}
+
+# helm_install_external_servers installs the chart with helm_install but
+# without servers of its own. Its clients join, and its components talk to,
+# the servers at EXTERNAL_SERVERS_ADDR over plain HTTP on
+# EXTERNAL_SERVERS_PORT (8500 by default). If EXTERNAL_SERVERS_TOKEN is set,
+# it is stored in a secret as the bootstrap token with which the chart
+# manages ACLs on those servers, and their Kubernetes auth method reaches
+# this cluster's API server at EXTERNAL_SERVERS_K8S_AUTH_METHOD_HOST, or
+# the address in the kubeconfig if that isn't set. Any arguments are
+# passed through to helm_install.
+# Example: helm_install_external_servers --set 'connectInject.enabled=true'
+helm_install_external_servers() {
+    local args=(
+        --set 'server.enabled=false'
+        --set 'externalServers.enabled=true'
+        --set "externalServers.hosts[0]=${EXTERNAL_SERVERS_ADDR}"
+        --set "externalServers.httpsPort=${EXTERNAL_SERVERS_PORT:-8500}"
+        --set "client.join[0]=${EXTERNAL_SERVERS_ADDR}"
+    )
+
+    if [ -n "${EXTERNAL_SERVERS_TOKEN}" ]; then
+        local host=${EXTERNAL_SERVERS_K8S_AUTH_METHOD_HOST:-$(kubectl config view --minify -o jsonpath='{.clusters[0].cluster.server}')}
+        create_secret external-servers-bootstrap-token token="${EXTERNAL_SERVERS_TOKEN}" || return 1
+        args+=(
+            --set 'global.acls.manageSystemACLs=true'
+            --set 'global.acls.bootstrapToken.secretName=external-servers-bootstrap-token'
+            --set 'global.acls.bootstrapToken.secretKey=token'
+            --set "externalServers.k8sAuthMethodHost=${host}"
+        )
+    fi
+
+    helm_install "${args[@]}" "$@"
+}
+
+# external_consul_api is consul_api for the servers at EXTERNAL_SERVERS_ADDR,
+# which it queries directly from the test with EXTERNAL_SERVERS_TOKEN, if
+# set, as the ACL token.
+# Example: external_consul_api /v1/catalog/services
+external_consul_api() {
+    CONSUL_API_ADDR="http://${EXTERNAL_SERVERS_ADDR}:${EXTERNAL_SERVERS_PORT:-8500}" \
+        CONSUL_HTTP_TOKEN="${EXTERNAL_SERVERS_TOKEN}" consul_api "$@"
+}
+
+# secondary_kubectl runs kubectl against the secondary cluster with the
+# given arguments.
+# Example: secondary_kubectl get pods
+secondary_kubectl() {
+    kubectl ${SECONDARY_KUBECONFIG:+--kubeconfig "${SECONDARY_KUBECONFIG}"} \
+        --context "${SECONDARY_KUBECONTEXT}" "$@"
+}
+
+# secondary_helm runs helm against the secondary cluster with the given
+# arguments.
+secondary_helm() {
+    helm ${SECONDARY_KUBECONFIG:+--kubeconfig "${SECONDARY_KUBECONFIG}"} \
+        --kube-context "${SECONDARY_KUBECONTEXT}" "$@"
+}
+
+# helm_install_secondary installs the Consul chart into the secondary
+# cluster under the same release name as helm_install. Any arguments are
+# passed through to `helm install`, e.g. the secondary datacenter's values.
+helm_install_secondary() {
+    local chart
+    chart=$(chart_path) || return 1
+    secondary_helm install \
+        --timeout "$(scaled_timeout 300)s" \
+        $(image_registry_args "${chart}") \
+        "$@" \
+        "$(name_prefix)" \
         --wait \
-        ${BATS_TEST_DIRNAME}/../..
+        "${chart}"
 }
 
-# helm_delete deletes the Consul chart and all resources.
-helm_delete() {
-    helm delete consul
-    kubectl delete --all pvc
+# helm_upgrade_secondary upgrades the release installed by
+# helm_install_secondary. Any arguments are passed through to
+# `helm upgrade`.
+helm_upgrade_secondary() {
+    local chart
+    chart=$(chart_path) || return 1
+    secondary_helm upgrade \
+        --timeout "$(scaled_timeout 300)s" \
+        $(image_registry_args "${chart}") \
+        "$@" \
+        "$(name_prefix)" \
+        --wait \
+        "${chart}"
+}
+
+# secondary_consul_api is consul_api for the Consul servers installed in
+# the secondary cluster by helm_install_secondary.
+# Example: secondary_consul_api /v1/catalog/services
+secondary_consul_api() {
+    KUBECONFIG="${SECONDARY_KUBECONFIG:-${KUBECONFIG}}" \
+        KUBECONTEXT="${SECONDARY_KUBECONTEXT}" consul_api "$@"
+}
+
+# helm_delete_secondary deletes the Consul chart and all its resources from
+# the secondary cluster in the same way as helm_delete, including the
+# federation secret copied there by copy_federation_secret.
+helm_delete_secondary() {
+    if secondary_helm status "$(name_prefix)" > /dev/null 2>&1; then
+        secondary_helm delete "$(name_prefix)"
+    fi
+
+    local resources=$(
+        secondary_kubectl get pvc -l "release=$(name_prefix)" -o name
+        secondary_kubectl get secrets -o name | grep "^secret/$(name_prefix)-consul-"
+    )
+    for resource in ${resources}; do
+        echo "Deleting ${resource} from the secondary cluster"
+        secondary_kubectl delete --ignore-not-found "${resource}"
+    done
 }
 
-# wait for a pod to be ready
+# federation_secret outputs the federation secret created by the primary
+# datacenter with global.federation.createFederationSecret as JSON, without
+# the metadata that ties it to the primary cluster.
+federation_secret() {
+    kubectl get secret "$(name_prefix)-consul-federation" -o json |
+        jq 'del(.metadata.uid, .metadata.resourceVersion, .metadata.creationTimestamp, .metadata.ownerReferences, .metadata.selfLink)'
+}
+
+# copy_federation_secret copies the primary datacenter's federation secret
+# to the secondary cluster so the secondary can be installed from it.
+copy_federation_secret() {
+    federation_secret | secondary_kubectl apply -f -
+}
+
+# wait_for_federation_secret waits until the primary datacenter has created
+# its federation secret, so that an install of the secondary can run
+# alongside the primary's with in_parallel and only copy the secret once
+# it exists.
+wait_for_federation_secret() {
+    for i in $(seq 150); do
+        if kubectl get secret "$(name_prefix)-consul-federation" > /dev/null 2>&1; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "The federation secret $(name_prefix)-consul-federation was never created."
+    return 1
+}
+
+# in_parallel runs each of the given commands in the background and waits
+# for all of them, so e.g. the datacenters in two clusters are installed at
+# the same time. Each argument is a label and a command separated by a
+# colon and every line the command outputs is prefixed with its label so
+# that the interleaved output stays readable. All commands run to
+# completion even if one fails, so each prints its own diagnostics, and
+# in_parallel then fails naming every command that did. A command that
+# depends on another, like a secondary datacenter's install on the
+# primary's federation secret, has to wait for what it needs itself, see
+# wait_for_federation_secret. The command is split on whitespace, so wrap
+# anything more complex in a function.
+# Example: in_parallel "dc1:install_primary" "dc2:install_secondary"
+in_parallel() {
+    local pids=() labels=() failed=()
+    local spec label
+    for spec in "$@"; do
+        label=${spec%%:*}
+        (
+            ${spec#*:} 2>&1 | while IFS= read -r line; do
+                echo "[${label}] ${line}"
+            done
+            exit "${PIPESTATUS[0]}"
+        ) &
+        pids+=($!)
+        labels+=("${label}")
+    done
+
+    for i in "${!pids[@]}"; do
+        if ! wait "${pids[$i]}"; then
+            failed+=("${labels[$i]}")
+        fi
+    done
+
+    if [ "${#failed[@]}" -gt 0 ]; then
+        echo "Failed: ${failed[*]}"
+        return 1
+    fi
+}
+
+# assert_cross_dc_service fails unless the given service in the given
+# datacenter can be discovered from the servers in the given Kubernetes
+# context, i.e. catalog requests are forwarded across the WAN.
+# Example: assert_cross_dc_service "$(kubectl config current-context)" static-server dc2
+assert_cross_dc_service() {
+    local nodes
+    for i in $(seq 30); do
+        nodes=$(KUBECONTEXT="$1" consul_api "/v1/catalog/service/$2?dc=$3" | jq -r 'length')
+        if [ "${nodes}" -gt "0" ] 2> /dev/null; then
+            echo "$2 in $3 is discoverable: ${nodes} instances."
+            return
+        fi
+
+        echo "Waiting for $2 in $3 to be discoverable..."
+        sleep 2
+    done
+
+    echo "$2 in $3 was never discoverable."
+    return 1
+}
+
+# assert_service_in_datacenters waits until the catalog of each of the
+# given datacenters has at least one instance of the given service, as
+# seen from the servers in the current Kubernetes context, or in
+# KUBECONTEXT if it is set, with requests to other datacenters forwarded
+# across the WAN. It fails if that never happens, printing how many
+# instances each datacenter has.
+# Example: assert_service_in_datacenters static-server dc1 dc2
+assert_service_in_datacenters() {
+    local service=$1
+    shift
+    local dc count status missing
+    for i in $(seq $(($(scaled_timeout 60) / 2))); do
+        status="" missing=""
+        for dc in "$@"; do
+            count=$(consul_api "/v1/catalog/service/${service}?dc=${dc}" | jq -r 'length' 2> /dev/null)
+            status="${status}  ${dc}: ${count:-unreachable} instances
+"
+            if ! [ "${count}" -gt "0" ] 2> /dev/null; then
+                missing="${missing} ${dc}"
+            fi
+        done
+        if [ -z "${missing}" ]; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "${service} is missing from${missing}:"
+    echo -n "${status}"
+    return 1
+}
+
+# assert_cross_dc_connection fails unless traffic from the given container
+# of the given pod to the given URL of one of its upstreams in another
+# datacenter is eventually "allowed" or "denied", as given. The upstream is
+# the one listening on the URL's port in the pod's
+# consul.hashicorp.com/connect-service-upstreams annotation, e.g.
+# "static-server:1234:dc2". Allowed traffic must also go through the mesh
+# gateways of the pod's datacenter, which are used with the chart's default
+# meshGateway.globalMode of local. The pod is looked up in the current
+# Kubernetes context.
+# Example: assert_cross_dc_connection static-client-abc123 static-client http://localhost:1234 allowed
+assert_cross_dc_connection() {
+    local pod=$1 container=$2 url=$3 expected=$4
+
+    local port=$(echo "${url}" | sed -E 's|^[a-z]+://[^:/]+:([0-9]+).*|\1|')
+    local upstream=$(kubectl get pod "${pod}" \
+        -o jsonpath='{.metadata.annotations.consul\.hashicorp\.com/connect-service-upstreams}' |
+        tr ',' '\n' | awk -F: -v port="${port}" '$2 == port')
+    local service=$(echo "${upstream}" | cut -d: -f1)
+    local dc=$(echo "${upstream}" | cut -d: -f3)
+    if [ -z "${dc}" ]; then
+        echo "${pod} has no upstream in another datacenter on port ${port}: ${upstream}"
+        return 1
+    fi
+
+    local actual=""
+    for i in $(seq 30); do
+        if kubectl exec "${pod}" -c "${container}" -- curl -sSf "${url}" > /dev/null; then
+            actual="allowed"
+        else
+            actual="denied"
+        fi
+        if [ "${actual}" = "${expected}" ]; then
+            break
+        fi
+        sleep 2
+    done
+    if [ "${actual}" != "${expected}" ]; then
+        echo "Traffic from ${pod} to ${service} in ${dc} was never ${expected}."
+        return 1
+    fi
+    echo "Traffic from ${pod} to ${service} in ${dc} is ${expected}."
+    if [ "${expected}" = "denied" ]; then
+        return
+    fi
+
+    local gateways=$(consul_api /v1/catalog/service/mesh-gateway | jq -r '.[].ServiceAddress')
+    local endpoints=$(envoy_endpoints "${pod}" "${service}")
+    if [ -z "${endpoints}" ]; then
+        echo "${pod}'s Envoy has no endpoints for ${service} in ${dc}."
+        return 1
+    fi
+    local endpoint
+    for endpoint in ${endpoints//,/ }; do
+        if ! echo "${gateways}" | grep -qxF "${endpoint}"; then
+            echo "${pod} reaches ${service} in ${dc} through ${endpoint}, which is not a mesh gateway: ${gateways}"
+            return 1
+        fi
+    done
+}
+
+# wait_for_intention waits until the intention from the given source to the
+# given destination service exists with the given action, allow or deny,
+# and Consul evaluates connections between the two accordingly, so that a
+# connectivity assertion made next isn't racing the intention. It fails,
+# printing what Consul reports, if that never happens. It goes through
+# consul_exec, so it uses CONSUL_HTTP_TOKEN when ACLs are enabled.
+# Example: wait_for_intention static-client static-server deny
+wait_for_intention() {
+    local source=$1 destination=$2 action=$3
+    local expected=Allowed
+    if [ "${action}" = "deny" ]; then
+        expected=Denied
+    fi
+
+    local actual="" check=""
+    for i in $(seq $(($(scaled_timeout 60) / 2))); do
+        actual=$(consul_exec intention get "${source}" "${destination}" | awk '$1 == "Action:" { print $2 }')
+        check=$(consul_exec intention check "${source}" "${destination}")
+        if [ "${actual}" = "${action}" ] && [ "${check}" = "${expected}" ]; then
+            return
+        fi
+        sleep 2
+    done
+
+    echo "The intention from ${source} to ${destination} has the action \"${actual}\" and checks as \"${check}\", expected ${action}."
+    return 1
+}
+
+# assert_cross_dc_intention fails unless traffic from the given pod to the
+# given URL of an upstream in another datacenter is allowed by default and
+# is then blocked by a deny intention between the two services, see
+# assert_cross_dc_connection. The pod is looked up in the current
+# Kubernetes context while the intention is created in the given one,
+# which should be the primary datacenter's since intentions are replicated
+# from it, and is deleted again by helm_delete.
+# Example: assert_cross_dc_intention "$(kubectl config current-context)" static-client-abc123 static-client static-server http://localhost:1234
+assert_cross_dc_intention() {
+    local context=$1 pod=$2 source=$3 destination=$4 url=$5
+
+    assert_cross_dc_connection "${pod}" "${source}" "${url}" allowed || return 1
+    kubectl --context "${context}" exec "$(name_prefix)-consul-server-0" -- \
+        consul intention create -deny "${source}" "${destination}" || return 1
+    register_cleanup kubectl --context "${context}" exec "$(name_prefix)-consul-server-0" -- \
+        consul intention delete "${source}" "${destination}"
+    assert_cross_dc_connection "${pod}" "${source}" "${url}" denied
+}
+
+# wait for a pod to be ready, within the optional timeout in seconds, 60 by
+# default, see scaled_timeout
 wait_for_ready() {
     POD_NAME=$1
 
@@ -41,7 +2960,7 @@ wait_for_ready() {
             ) | .metadata.namespace + "/" + .metadata.name'
     }
 
-    for i in $(seq 30); do
+    for i in $(seq $(($(scaled_timeout ${2:-60}) / 2))); do
         if [ -n "$(check ${POD_NAME})" ]; then
             echo "${POD_NAME} is ready."
             return
@@ -0,0 +1,37 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+  rm -f "${BATS_TMPDIR}/client-auto-join-values.yaml"
+}
+
+@test "client/auto-join: clients discover servers through a cloud auto-join provider" {
+  # Adds the Kubernetes cloud auto-join provider to the addresses clients
+  # join. The servers' headless service is still listed so the clients can
+  # join, and become ready, when the provider finds nothing.
+  cat > "${BATS_TMPDIR}/client-auto-join-values.yaml" <<EOT
+client:
+  join:
+    - 'provider=k8s label_selector="release=$(name_prefix),component=server"'
+    - '$(name_prefix)-consul-server'
+EOT
+  helm_install -f "${BATS_TMPDIR}/client-auto-join-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # The provider string reaches the agent, which uses it for discovery. The
+  # clients' service account can't list pods so discovery through it is
+  # expected to fail, but the attempt shows the config was plumbed through.
+  local client=$(pod_name "release=$(name_prefix),component=client")
+  local logs=""
+  for i in $(seq 30); do
+    logs=$(kubectl logs ${client})
+    if [[ "${logs}" =~ "discover-k8s" ]]; then
+      break
+    fi
+    sleep 2
+  done
+  echo "${logs}"
+  [[ "${logs}" =~ "discover-k8s" ]]
+}
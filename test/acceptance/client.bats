@@ -0,0 +1,38 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "client: catalog writes through a client agent are forwarded to the servers" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local client=$(pod_name "release=$(name_prefix),component=client")
+  wait_for_ready ${client}
+  assert_client_connected ${client}
+
+  # Register through the client's local HTTP API so the write has to be
+  # forwarded over RPC to the servers.
+  kubectl exec "${client}" -- curl -sSf -X PUT \
+      -d '{"Node": "client-rpc-test", "Address": "127.0.0.1"}' \
+      http://127.0.0.1:8500/v1/catalog/register
+
+  [ "$(consul_api /v1/catalog/node/client-rpc-test | jq -r '.Node.Node')" = "client-rpc-test" ]
+}
+
+@test "client: RPCs to the servers beyond limits.rpc_rate are rejected" {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/client-rpc-limits-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local client=$(pod_name "release=$(name_prefix),component=client")
+  wait_for_ready ${client}
+
+  # Every catalog read is an RPC so a burst of them exhausts the limit.
+  local responses=$(kubectl exec "${client}" -- sh -c \
+      'for i in $(seq 30); do curl -sS http://127.0.0.1:8500/v1/catalog/services; echo; done')
+  echo "${responses}"
+  [[ "${responses}" =~ "RPC rate limit exceeded" ]]
+}
@@ -0,0 +1,33 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/access-log: proxy-defaults set the sidecars' access log format" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # Consul 1.8 has no access log settings so the public listener is
+  # replaced through the envoy_public_listener_json escape hatch. Consul
+  # still adds its mTLS and authorization to the listener.
+  set_proxy_defaults "$(jq -n --arg listener "$(cat "${BATS_TEST_DIRNAME}/fixtures/public-listener-access-log.json")" \
+      '{envoy_public_listener_json: $listener}')"
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_endpoints ${client} static-server 1
+  [[ "$(kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234)" =~ "hello world" ]]
+
+  local logs=$(kubectl logs "$(pod_name app=static-server)" -c envoy-sidecar)
+  echo "${logs}"
+  echo "${logs}" | grep -qE '^ACCESS upstream=local_app received=[0-9]+ sent=[0-9]+$'
+}
@@ -0,0 +1,52 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/web-identity-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/web-identity-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/acl-identity: the ServiceAccount determines the service identity" {
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'global.acls.manageSystemACLs=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/web-identity-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/web-identity-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  CONSUL_HTTP_TOKEN=$(acl_bootstrap_token)
+  export CONSUL_HTTP_TOKEN
+
+  # The injector's login created a token for the ServiceAccount's identity.
+  local identities=$(consul_api /v1/acl/tokens |
+      jq -r '[ .[] | select(.AuthMethod != null) | .ServiceIdentities[]?.ServiceName ] | sort | join(",")')
+  echo "${identities}"
+  [[ "${identities}" =~ "web-identity" ]]
+  assert_service_registered web-identity
+
+  # With ACLs enabled intentions default to deny, and allowing the
+  # identity rather than the Kubernetes service name lets traffic through.
+  # The client's sidecar accepts the connection, but the server's sidecar
+  # closes it rather than refusing it as nothing listening would.
+  local client=$(pod_name app=static-client)
+  run pod_exec -c static-client ${client} curl -sSf http://localhost:1234
+  echo "${output}"
+  [ "$status" -eq 52 ] || [ "$status" -eq 56 ]
+
+  consul_exec intention create -allow static-client web-identity
+  wait_for_intention static-client web-identity allow
+  local allowed=""
+  for i in $(seq 30); do
+    if kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234; then
+      allowed="true"
+      break
+    fi
+    sleep 2
+  done
+  [ "${allowed}" = "true" ]
+}
@@ -0,0 +1,57 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/ca: leaf certificates honor the tuned CA config and are reissued on rotation" {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/connect-ca-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local config=$(consul_api /v1/connect/ca/configuration)
+  echo "${config}"
+  [ "$(echo "${config}" | jq -r '.Config.LeafCertTTL')" = "1h0m0s" ]
+  [ "$(echo "${config}" | jq -r '.Config.CSRMaxConcurrent')" = "2" ]
+
+  # Leaf certificates are valid for the TTL plus the minute they are
+  # backdated by to allow for clock skew.
+  local validity=$(consul_api /v1/agent/connect/ca/leaf/static-server |
+      jq -r '[ .ValidBefore, .ValidAfter | sub("\\.[0-9]+"; "") | fromdateiso8601 ] | .[0] - .[1]')
+  [ "${validity}" -le "3900" ]
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_endpoints ${client} static-server 1
+  local serial=$(leaf_cert_serial ${client})
+  [ -n "${serial}" ]
+  start_request_loop ${client} static-client http://localhost:1234
+
+  # Setting the config without a private key generates a new root which
+  # makes every leaf certificate be reissued. The shortest TTL Consul
+  # accepts is an hour, so a rotation is how a reissue is observed here.
+  rotate_connect_ca "${BATS_TEST_DIRNAME}/fixtures/connect-ca-config.json"
+
+  local reissued=""
+  for i in $(seq 30); do
+    if [ "$(leaf_cert_serial ${client})" != "${serial}" ]; then
+      reissued="true"
+      break
+    fi
+    sleep 2
+  done
+  [ "${reissued}" = "true" ]
+
+  # Traffic kept flowing throughout the rotation and does so with the
+  # reissued certificates.
+  sleep 10
+  stop_request_loop ${client}
+  [[ "$(kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234)" =~ "hello world" ]]
+}
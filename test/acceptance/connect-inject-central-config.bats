@@ -0,0 +1,24 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "connect-inject/central-config: proxy-defaults are bootstrapped from values" {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/proxy-defaults-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  [ "$(config_entry_field proxy-defaults global Config.envoy_prometheus_bind_addr)" = "0.0.0.0:9102" ]
+}
+
+@test "connect-inject/central-config: config entries written via the CLI can be read back" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_leader
+
+  config_write "${BATS_TEST_DIRNAME}/fixtures/service-defaults.hcl"
+
+  [ "$(config_entry_field service-defaults static-server Protocol)" = "http" ]
+}
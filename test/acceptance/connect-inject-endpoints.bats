@@ -0,0 +1,23 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "connect-inject/endpoints: Envoy upstream endpoints track the Consul catalog" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  deploy_static_server
+  local client
+  client=$(deploy_static_client)
+  wait_for_envoy_endpoints ${client} static-server 1
+
+  # Scaling the upstream must propagate the new instances to Envoy.
+  kubectl scale deploy/static-server --replicas=3
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+
+  wait_for_envoy_endpoints ${client} static-server 3
+}
@@ -0,0 +1,27 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/envoy-image: sidecars run the pinned Envoy image" {
+  local image="envoyproxy/envoy-alpine:v1.14.4"
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set "connectInject.imageEnvoy=${image}"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+
+  local pod=$(pod_name app=static-server)
+  [ "$(kubectl_jq '.spec.containers[] | select(.name == "envoy-sidecar") | .image' pod ${pod})" = "${image}" ]
+
+  # The proxy is running and reports the pinned version.
+  local info=$(kubectl exec ${pod} -c envoy-sidecar -- wget -qO- http://127.0.0.1:19000/server_info)
+  [ "$(echo "${info}" | jq -r '.state')" = "LIVE" ]
+  [[ "$(echo "${info}" | jq -r '.version')" =~ "/1.14.4/" ]]
+}
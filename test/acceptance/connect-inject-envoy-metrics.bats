@@ -0,0 +1,41 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+# upstream_requests outputs the number of requests the given static-client
+# pod's sidecar has sent to static-server.
+upstream_requests() {
+  scrape_metrics $1 envoy-sidecar 19000 /stats/prometheus |
+      metric_value envoy_cluster_upstream_rq_total static-server
+}
+
+@test "connect-inject/envoy-metrics: upstream request counters follow traffic" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # Envoy only counts requests for HTTP upstreams.
+  set_service_defaults static-server http
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_endpoints ${client} static-server 1
+  wait_for_upstream_protocol ${client} static-server http
+
+  local before=$(upstream_requests ${client} || echo 0)
+  for i in $(seq 3); do
+    kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234
+  done
+  local after=$(upstream_requests ${client})
+  echo "Requests to static-server went from ${before} to ${after}"
+  [ "${after}" -ge "$((before + 3))" ]
+}
@@ -0,0 +1,45 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+# deploy_and_wait_for_xds deploys static-server and static-client and waits
+# for the client's proxy to receive its upstream over xDS.
+deploy_and_wait_for_xds() {
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  wait_for_envoy_endpoints $(pod_name app=static-client) static-server 1
+}
+
+@test "connect-inject/grpc: proxies receive xDS over plaintext gRPC" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  deploy_and_wait_for_xds
+}
+
+@test "connect-inject/grpc: proxies receive xDS over gRPC secured with TLS" {
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'global.tls.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  deploy_and_wait_for_xds
+
+  # The client agents' gRPC port only accepts TLS, so proxies that synced
+  # above did so over the secured channel and a plaintext one is refused.
+  local agent=$(pod_name "release=$(name_prefix),component=client")
+  kubectl exec "${agent}" -- \
+      curl -sS --http2 --cacert /consul/tls/ca/tls.crt -o /dev/null https://127.0.0.1:8502/
+  run kubectl exec "${agent}" -- \
+      curl -sS --http2-prior-knowledge -o /dev/null http://127.0.0.1:8502/
+  [ "$status" -ne 0 ]
+}
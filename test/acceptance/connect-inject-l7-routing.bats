@@ -0,0 +1,43 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/l7-routing: a service-router's path prefix routes to another service's cluster" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  set_service_defaults static-server http
+  set_service_defaults static-server-admin http
+  config_write "${BATS_TEST_DIRNAME}/fixtures/service-router-prefix.hcl"
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_ready ${client}
+  wait_for_upstream_protocol ${client} static-server http
+
+  local routes=""
+  for i in $(seq 30); do
+    routes=$(envoy_routes ${client})
+    if echo "${routes}" | grep -q '^static-server prefix:/admin '; then
+      break
+    fi
+    sleep 2
+  done
+  echo "${routes}"
+
+  # /admin goes to static-server-admin and everything else to static-server.
+  echo "${routes}" | grep -q '^static-server prefix:/admin static-server-admin\.default\.dc1\.'
+  echo "${routes}" | grep -q '^static-server prefix:/ static-server\.default\.dc1\.'
+  envoy_clusters ${client} | grep -q '^static-server-admin\.default\.dc1\.'
+  envoy_listeners ${client} | grep -q '^static-server:127\.0\.0\.1:1234 127\.0\.0\.1:1234$'
+}
@@ -0,0 +1,47 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server-httpbin.yaml"
+  helm_delete
+}
+
+# status_code outputs the HTTP status code of a request through the given
+# static-client pod's upstream to the given path.
+status_code() {
+  kubectl exec $1 -c static-client -- \
+      curl -s -o /dev/null -w '%{http_code}' "http://localhost:1234$2"
+}
+
+@test "connect-inject/l7-timeout: a service-router's request timeout is enforced between sidecars" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  set_service_defaults static-server http
+  config_write "${BATS_TEST_DIRNAME}/fixtures/service-router-timeout.hcl"
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server-httpbin.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_endpoints ${client} static-server 1
+  wait_for_upstream_protocol ${client} static-server http
+
+  # Wait until the client's sidecar has the router's route so that a 504
+  # can only come from the timeout.
+  for i in $(seq 30); do
+    if envoy_routes ${client} | grep -q '^static-server prefix:/ .* 2s$'; then
+      break
+    fi
+    sleep 2
+  done
+  envoy_routes ${client} | grep -q '^static-server prefix:/ .* 2s$'
+  [ "$(status_code ${client} /delay/0)" = "200" ]
+
+  # The upstream takes longer than the 2s timeout so Envoy gives up on it.
+  [ "$(status_code ${client} /delay/5)" = "504" ]
+}
@@ -0,0 +1,30 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found namespace limited
+  helm_delete
+}
+
+@test "connect-inject/LimitRange: injected pods run in a namespace with a LimitRange" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl create namespace limited
+  kubectl apply -n limited -f "${BATS_TEST_DIRNAME}/fixtures/limitrange.yaml"
+  kubectl apply -n limited -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status -n limited --timeout=$(scaled_timeout 120)s deploy/static-server
+
+  local pod=$(kubectl get pods -n limited -l app=static-server -o jsonpath='{.items[0].metadata.name}')
+
+  # The sidecar was injected without explicit resources so the LimitRange
+  # defaults apply, and it must still come up.
+  local limit=$(kubectl_jq '.spec.containers[] | select(.name == "envoy-sidecar") | .resources.limits.memory' \
+      pod -n limited "${pod}")
+  [ "${limit}" = "64Mi" ]
+
+  local ready=$(kubectl_jq '.status.containerStatuses[] | select(.name == "envoy-sidecar") | .ready' \
+      pod -n limited "${pod}")
+  [ "${ready}" = "true" ]
+}
@@ -0,0 +1,37 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/load: sidecars serve concurrent requests while the service's config changes" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  set_service_defaults static-server http
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_endpoints ${client} static-server 1
+  wait_for_upstream_protocol ${client} static-server http
+
+  # A service-router written part way through changes the routes Envoy
+  # serves the requests with.
+  (sleep 10 && config_write "${BATS_TEST_DIRNAME}/fixtures/service-router-timeout.hcl") 3>&- &
+  local requests failures p50 p90 p99
+  read -r requests failures p50 p90 p99 < \
+      <(load_test ${client} static-client http://localhost:1234 10 30)
+  wait
+
+  [ "${requests}" -gt 0 ]
+  [ "${failures}" -eq 0 ]
+  [ "${p99}" -lt 1000 ]
+  envoy_routes ${client} | grep -q '^static-server prefix:/ .* 2s$'
+}
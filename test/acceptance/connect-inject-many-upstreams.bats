@@ -0,0 +1,32 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "connect-inject/many-upstreams: every upstream of a pod with 50 gets a listener" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  deploy_static_server
+  # static-server on localhost:1234 and stub-1 to stub-49, which have no
+  # instances, on localhost:20001 to localhost:20049.
+  local upstreams="static-server:1234"
+  for i in $(seq 49); do
+    upstreams="${upstreams},stub-${i}:$((20000 + i))"
+  done
+  local client
+  client=$(deploy_static_client --upstreams "${upstreams}")
+  wait_for_envoy_endpoints ${client} static-server 1
+
+  # One listener per upstream, in addition to the public listener.
+  local listeners=$(kubectl exec ${client} -c envoy-sidecar -- \
+      wget -qO- "http://127.0.0.1:19000/listeners?format=json" |
+      jq '[ .listener_statuses[] | select(.local_address.socket_address.address == "127.0.0.1") ] | length')
+  [ "${listeners}" -eq "50" ]
+
+  # A sample of the routes still works.
+  [[ "$(kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234)" =~ "hello world" ]]
+}
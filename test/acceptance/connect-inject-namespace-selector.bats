@@ -0,0 +1,43 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+# The namespaces are cluster-scoped, so they're suffixed with the release
+# name to keep tests against different releases apart.
+enabled_namespace() {
+  echo "inject-enabled-$(name_prefix)"
+}
+
+excluded_namespace() {
+  echo "inject-excluded-$(name_prefix)"
+}
+
+teardown() {
+  kubectl delete --ignore-not-found namespace "$(enabled_namespace)" "$(excluded_namespace)"
+  helm_delete
+}
+
+# has_sidecar outputs "true" if the static-server pod in the given
+# namespace was injected with a sidecar and "false" otherwise.
+has_sidecar() {
+  kubectl get pods --namespace $1 -l app=static-server -o json |
+      jq -r '[ .items[0].spec.containers[].name ] | any(. == "envoy-sidecar")'
+}
+
+@test "connect-inject/namespace-selector: only pods in selected namespaces are injected" {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/namespace-selector-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  assert_webhook_namespace_selector '{"matchLabels": {"connect-inject": "enabled"}}'
+
+  kubectl create namespace "$(enabled_namespace)"
+  kubectl label namespace "$(enabled_namespace)" connect-inject=enabled
+  kubectl create namespace "$(excluded_namespace)"
+  for namespace in "$(enabled_namespace)" "$(excluded_namespace)"; do
+    kubectl apply --namespace ${namespace} -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+    kubectl rollout status --namespace ${namespace} --timeout=$(scaled_timeout 120)s deploy/static-server
+  done
+
+  [ "$(has_sidecar "$(enabled_namespace)")" = "true" ]
+  [ "$(has_sidecar "$(excluded_namespace)")" = "false" ]
+}
@@ -0,0 +1,28 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "connect-inject/outbound-only: pods without ports can reach their upstreams" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  deploy_static_server
+  local client
+  client=$(deploy_static_client)
+
+  # static-client defines no container ports so its proxy is registered
+  # without a local service port to route inbound traffic to.
+  [ "$(kubectl get pod ${client} -o json |
+      jq '[ .spec.containers[] | select(.name == "static-client") | .ports // [] | length ] | add')" = "0" ]
+  local proxy=$(consul_api /v1/catalog/service/static-client-sidecar-proxy)
+  echo "${proxy}"
+  [ "$(echo "${proxy}" | jq -r '.[0].ServiceProxy.DestinationServiceName')" = "static-client" ]
+  [ "$(echo "${proxy}" | jq -r '.[0].ServiceProxy.LocalServicePort // 0')" = "0" ]
+
+  wait_for_envoy_endpoints ${client} static-server 1
+  [[ "$(kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234)" =~ "hello world" ]]
+}
@@ -0,0 +1,63 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/pod-restart: the catalog follows a recreated pod's new IP" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_ready ${client}
+  wait_for_envoy_endpoints ${client} static-server 1
+  assert_envoy_upstream_healthy ${client} static-server
+  local old_ip=$(kubectl get pods -l app=static-server -o jsonpath='{.items[0].status.podIP}')
+
+  # The new pod can be given the old one's IP, which wouldn't show that the
+  # catalog follows it, so it's recreated until it gets a different one.
+  local new_ip="${old_ip}"
+  for i in $(seq 3); do
+    kubectl delete pods -l app=static-server --wait
+    kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+    new_ip=$(kubectl get pods -l app=static-server -o jsonpath='{.items[0].status.podIP}')
+    if [ "${new_ip}" != "${old_ip}" ]; then
+      break
+    fi
+  done
+  echo "static-server moved from ${old_ip} to ${new_ip}"
+  [ "${new_ip}" != "${old_ip}" ]
+
+  # Only the new IP is left in the catalog, it reaches the client's proxy
+  # and traffic keeps flowing.
+  wait_for_envoy_endpoints ${client} static-server 1
+  [ "$(catalog_endpoints static-server)" = "${new_ip}" ]
+  [[ "$(kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234)" =~ "hello world" ]]
+}
+
+@test "connect-inject/pod-restart: deleting one of several upstream pods drops few requests" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  deploy_static_server
+  kubectl scale deploy/static-server --replicas=2
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  local client
+  client=$(deploy_static_client)
+  wait_for_envoy_endpoints ${client} static-server 2
+
+  # The injected sidecar deregisters the service when the pod is deleted,
+  # but Envoy doesn't drain connections, so a request that is in flight at
+  # that moment can still fail.
+  delete_pod_and_monitor "$(pod_name app=static-server)" 1 \
+      kubectl exec ${client} -c static-client -- curl -sSf --max-time 5 http://localhost:1234
+}
@@ -0,0 +1,42 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/sidecar-resources: chart defaults apply unless overridden per pod" {
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'connectInject.sidecarProxy.resources.requests.cpu=50m' \
+      --set 'connectInject.sidecarProxy.resources.requests.memory=50Mi' \
+      --set 'connectInject.sidecarProxy.resources.limits.cpu=200m' \
+      --set 'connectInject.sidecarProxy.resources.limits.memory=150Mi'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # Without annotations the sidecar gets the chart defaults.
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  local resources
+  resources=$(assert_injected "$(pod_name app=static-server)")
+  echo "${resources}"
+  [ "$(echo "${resources}" | jq -r '.requests.cpu')" = "50m" ]
+  [ "$(echo "${resources}" | jq -r '.requests.memory')" = "50Mi" ]
+  [ "$(echo "${resources}" | jq -r '.limits.cpu')" = "200m" ]
+  [ "$(echo "${resources}" | jq -r '.limits.memory')" = "150Mi" ]
+
+  # Annotations take precedence over the defaults they override only.
+  kubectl patch deployment static-server -p '{"spec": {"template": {"metadata": {"annotations": {
+    "consul.hashicorp.com/sidecar-proxy-cpu-limit": "300m",
+    "consul.hashicorp.com/sidecar-proxy-memory-request": "75Mi"
+  }}}}}'
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  resources=$(assert_injected "$(pod_name app=static-server)")
+  echo "${resources}"
+  [ "$(echo "${resources}" | jq -r '.requests.cpu')" = "50m" ]
+  [ "$(echo "${resources}" | jq -r '.requests.memory')" = "75Mi" ]
+  [ "$(echo "${resources}" | jq -r '.limits.cpu')" = "300m" ]
+  [ "$(echo "${resources}" | jq -r '.limits.memory')" = "150Mi" ]
+}
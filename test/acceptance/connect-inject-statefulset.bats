@@ -0,0 +1,44 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server-statefulset.yaml"
+  helm_delete
+}
+
+# service_ids outputs the sorted, comma-separated IDs of the static-server
+# instances registered in the catalog.
+service_ids() {
+  consul_api /v1/catalog/service/static-server |
+      jq -r '[ .[].ServiceID ] | sort | join(",")'
+}
+
+@test "connect-inject/StatefulSet: each replica registers a stable service instance" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server-statefulset.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s statefulset/static-server
+
+  # Each ordinal pod is its own instance, keyed on the stable pod name.
+  local expected="static-server-0-static-server,static-server-1-static-server"
+  [ "$(service_ids)" = "${expected}" ]
+
+  # Restarting a replica brings it back under the same identity rather than
+  # registering an additional instance.
+  kubectl delete pod static-server-0
+  kubectl rollout status --timeout=$(scaled_timeout 120)s statefulset/static-server
+  wait_for_ready static-server-0
+
+  for i in $(seq 30); do
+    if [ "$(service_ids)" = "${expected}" ]; then
+      return
+    fi
+    echo "Waiting for static-server instances to converge..."
+    sleep 2
+  done
+
+  echo "static-server instances are $(service_ids), expected ${expected}"
+  return 1
+}
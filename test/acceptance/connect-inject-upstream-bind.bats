@@ -0,0 +1,37 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/upstream-bind: upstreams listen on 127.0.0.1 and the annotated port" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_endpoints ${client} static-server 1
+
+  # The upstream annotation only sets the port; the injector leaves the
+  # address to Consul's default of 127.0.0.1.
+  local addresses=$(envoy_admin ${client} "/listeners?format=json" |
+      jq -r '[ .listener_statuses[].local_address.socket_address |
+          select(.port_value == 1234) | .address ] | join(",")')
+  [ "${addresses}" = "127.0.0.1" ]
+
+  # So the app reaches the upstream on the loopback address but not on the
+  # pod's IP.
+  [[ "$(kubectl exec ${client} -c static-client -- curl -sSf http://127.0.0.1:1234)" =~ "hello world" ]]
+  local ip=$(kubectl get pod ${client} -o jsonpath='{.status.podIP}')
+  run pod_exec -c static-client ${client} curl -sSf "http://${ip}:1234"
+  echo "${output}"
+  [ "$status" -eq 7 ]
+}
@@ -0,0 +1,15 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "connect-inject/webhook-cert: the generated webhook certificate is valid" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  kubectl rollout status --timeout=$(scaled_timeout 120)s "deploy/$(name_prefix)-consul-connect-injector-webhook-deployment"
+
+  assert_webhook_cert_valid
+}
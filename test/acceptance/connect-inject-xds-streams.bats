@@ -0,0 +1,26 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "connect-inject/xds-streams: xDS streams track the number of proxies" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_xds_streams 0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  wait_for_xds_streams 1
+
+  kubectl scale deploy/static-server --replicas=3
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  wait_for_xds_streams 3
+
+  # Streams of removed proxies are closed rather than leaked.
+  kubectl scale deploy/static-server --replicas=0
+  wait_for_xds_streams 0
+}
@@ -0,0 +1,66 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "dns: services resolve to their instances' pod IPs" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl scale deploy/static-server --replicas=2
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  assert_service_healthy static-server 2
+
+  local ips=$(kubectl get pods -l app=static-server -o jsonpath='{.items[*].status.podIP}' |
+      tr ' ' '\n' | sort | paste -sd, -)
+  [ "$(dig_consul_dns static-server.service.consul)" = "${ips}" ]
+
+  # SRV records also carry the port the app was registered with.
+  local ports=$(dig_consul_dns static-server.service.consul SRV | tr ',' '\n' | cut -d' ' -f1 | sort -u)
+  [ "${ports}" = "8080" ]
+}
+
+@test "dns: the DNS service isn't created when dns.enabled is false" {
+  helm_install --set 'dns.enabled=false'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  run kubectl get service "$(name_prefix)-consul-dns"
+  [ "$status" -ne 0 ]
+}
+
+# This changes the DNS configuration of the whole cluster so it can't run
+# in parallel with itself, see configure_dns_stub_domain.
+@test "dns: any pod resolves .consul names once the cluster's DNS forwards them" {
+  if is_openshift; then
+    skip "OpenShift's DNS operator manages CoreDNS's configuration"
+  fi
+  if dns_stub_domain_configured; then
+    skip "the cluster's DNS already forwards the consul domain"
+  fi
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  deploy_static_server
+  assert_service_healthy static-server
+
+  configure_dns_stub_domain
+  assert_dns_stub_domain "$(kubectl get service "$(name_prefix)-consul-dns" -o jsonpath='{.spec.clusterIP}')"
+
+  # The cluster's DNS reloads its configuration within a minute or two.
+  local ip=$(kubectl get pods -l app=static-server -o jsonpath='{.items[0].status.podIP}')
+  local resolved=""
+  for i in $(seq $(($(scaled_timeout 180) / 10))); do
+    resolved=$(dig_cluster_dns static-server.service.consul)
+    if [ "${resolved}" = "${ip}" ]; then
+      break
+    fi
+    sleep 5
+  done
+  echo "static-server.service.consul resolved to \"${resolved}\", expected ${ip}"
+  [ "${resolved}" = "${ip}" ]
+}
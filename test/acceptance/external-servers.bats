@@ -0,0 +1,40 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+# These tests install the chart without servers against a Consul cluster
+# running outside of Kubernetes, see skip_unless_external_servers.
+
+teardown() {
+  helm_delete
+}
+
+@test "external-servers: clients join the external servers" {
+  skip_unless_external_servers
+
+  helm_install_external_servers
+
+  run kubectl get pods -l "release=$(name_prefix),component=server" -o name
+  [ -z "${output}" ]
+
+  local nodes=$(kubectl get pods -l "release=$(name_prefix),component=client" \
+      -o jsonpath='{.items[*].spec.nodeName}')
+  [ -n "${nodes}" ]
+  for node in ${nodes}; do
+    [ "$(external_consul_api /v1/catalog/node/${node} | jq -r '.Node.Node')" = "${node}" ]
+  done
+}
+
+@test "external-servers: connect-injected services register with the external servers" {
+  skip_unless_external_servers
+
+  helm_install_external_servers --set 'connectInject.enabled=true'
+
+  deploy_static_server > /dev/null
+
+  local addr="http://${EXTERNAL_SERVERS_ADDR}:${EXTERNAL_SERVERS_PORT:-8500}"
+  CONSUL_API_ADDR="${addr}" CONSUL_HTTP_TOKEN="${EXTERNAL_SERVERS_TOKEN}" \
+      assert_service_healthy static-server
+  CONSUL_API_ADDR="${addr}" CONSUL_HTTP_TOKEN="${EXTERNAL_SERVERS_TOKEN}" \
+      assert_service_healthy static-server-sidecar-proxy
+}
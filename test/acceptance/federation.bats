@@ -0,0 +1,168 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+# These tests install the primary datacenter into the current Kubernetes
+# context and the secondary into the secondary cluster, see
+# skip_unless_secondary_cluster.
+
+teardown() {
+  rm -f "${BATS_TMPDIR}/primary-gateways-values.yaml" "${BATS_TMPDIR}/federation-secret-values.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  if [ -n "${SECONDARY_KUBECONTEXT}" ]; then
+    secondary_kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+    secondary_kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server-dc2.yaml"
+    helm_delete_secondary
+  fi
+  helm_delete
+}
+
+# install_primary installs the primary datacenter.
+install_primary() {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/federation-primary-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+}
+
+# federation_secret_values writes the values that give the secondary the
+# CA from the federation secret copied from the primary, which is named
+# after the release, and outputs the file's path. With --server-config the
+# servers also load the primary's datacenter and gateways from it.
+federation_secret_values() {
+  local secret="$(name_prefix)-consul-federation"
+  local file="${BATS_TMPDIR}/federation-secret-values.yaml"
+  cat > "${file}" <<EOT
+global:
+  tls:
+    caCert:
+      secretName: ${secret}
+      secretKey: caCert
+    caKey:
+      secretName: ${secret}
+      secretKey: caKey
+EOT
+  if [ "$1" = "--server-config" ]; then
+    cat >> "${file}" <<EOT
+server:
+  extraVolumes:
+    - type: secret
+      name: ${secret}
+      items:
+        - key: serverConfigJSON
+          path: config.json
+      load: true
+EOT
+  fi
+  echo "${file}"
+}
+
+# install_secondary installs the secondary datacenter once the primary has
+# created its federation secret and the secret has been copied over.
+install_secondary() {
+  wait_for_federation_secret &&
+    copy_federation_secret &&
+    helm_install_secondary -f "${BATS_TEST_DIRNAME}/fixtures/federation-secondary-values.yaml" \
+        -f "$(federation_secret_values --server-config)"
+}
+
+# install_datacenters installs both datacenters at the same time, see
+# in_parallel.
+install_datacenters() {
+  in_parallel "dc1:install_primary" "dc2:install_secondary"
+}
+
+# client_response curls static-server through the given static-client
+# pod's upstream until the response contains the given text, e.g. once
+# traffic has moved to another datacenter, and outputs the last response.
+client_response() {
+  local response=""
+  for i in $(seq 30); do
+    response=$(kubectl exec $1 -c static-client -- curl -sS http://localhost:1234)
+    if [[ "${response}" =~ "$2" ]]; then
+      break
+    fi
+    sleep 2
+  done
+  echo "${response}"
+}
+
+@test "federation: services and intentions work across datacenters" {
+  skip_unless_secondary_cluster
+
+  install_datacenters
+
+  secondary_kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  secondary_kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  local client
+  client=$(deploy_static_client --upstreams static-server:1234:dc2)
+
+  assert_cross_dc_service "$(kubectl config current-context)" static-server dc2
+  [ "$(secondary_consul_api /v1/catalog/service/static-server | jq -r '.[0].Datacenter')" = "dc2" ]
+  assert_cross_dc_intention "$(kubectl config current-context)" \
+      "${client}" static-client static-server http://localhost:1234
+}
+
+@test "federation: secondaries federate through primary_gateways set in server.extraConfig" {
+  skip_unless_secondary_cluster
+  skip_unless_load_balancer
+
+  install_primary
+  copy_federation_secret
+
+  local gateway
+  gateway=$(gateway_external_address "$(name_prefix)-consul-mesh-gateway" 443)
+
+  cat > "${BATS_TMPDIR}/primary-gateways-values.yaml" <<EOT
+server:
+  extraConfig: |
+    {"primary_datacenter": "dc1", "primary_gateways": ["${gateway}"]}
+EOT
+  helm_install_secondary \
+      -f "${BATS_TEST_DIRNAME}/fixtures/federation-secondary-primary-gateways-values.yaml" \
+      -f "$(federation_secret_values)" \
+      -f "${BATS_TMPDIR}/primary-gateways-values.yaml"
+
+  # The secondary's servers reach the primary's through the gateways.
+  local members=""
+  for i in $(seq 30); do
+    members=$(secondary_kubectl exec "$(name_prefix)-consul-server-0" -- consul members -wan)
+    if [[ "${members}" =~ ".dc1" ]]; then
+      break
+    fi
+    sleep 2
+  done
+  echo "${members}"
+  [[ "${members}" =~ "$(name_prefix)-consul-server-0.dc1" ]]
+}
+
+@test "federation: traffic fails over to the secondary through a service-resolver" {
+  skip_unless_secondary_cluster
+
+  install_datacenters
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  secondary_kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server-dc2.yaml"
+  secondary_kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  # Both datacenters' instances are discoverable from either datacenter.
+  assert_service_in_datacenters static-server dc1 dc2
+  KUBECONFIG="${SECONDARY_KUBECONFIG:-${KUBECONFIG}}" KUBECONTEXT="${SECONDARY_KUBECONTEXT}" \
+      assert_service_in_datacenters static-server dc1 dc2
+
+  config_write "${BATS_TEST_DIRNAME}/fixtures/service-resolver-failover.hcl"
+
+  local client=$(pod_name app=static-client)
+  [[ "$(client_response ${client} "hello world")" =~ "hello world" ]]
+
+  # Without healthy instances in dc1 traffic fails over to dc2...
+  kubectl scale deploy/static-server --replicas=0
+  [[ "$(client_response ${client} "hello from dc2")" =~ "hello from dc2" ]]
+
+  # ...and returns once they are back.
+  kubectl scale deploy/static-server --replicas=1
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  [[ "$(client_response ${client} "hello world")" =~ "hello world" ]]
+}
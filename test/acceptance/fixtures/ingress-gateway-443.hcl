@@ -0,0 +1,13 @@
+Kind = "ingress-gateway"
+Name = "ingress-gateway"
+Listeners = [
+  {
+    Port     = 443
+    Protocol = "tcp"
+    Services = [
+      {
+        Name = "static-server"
+      }
+    ]
+  }
+]
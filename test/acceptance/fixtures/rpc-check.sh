@@ -0,0 +1,27 @@
+# Run inside a server pod by consul_rpc_accepts. Starts a temporary client
+# agent, presenting the server's certificate as its client certificate if
+# the first argument is "with-cert", and outputs the HTTP status of a KV
+# read it forwards to the servers over RPC: 404 if the servers accepted the
+# RPC and 500 if they refused it.
+cert_args=""
+if [ "$1" = "with-cert" ]; then
+  cert_args="-hcl=cert_file=\"/consul/tls/server/tls.crt\" -hcl=key_file=\"/consul/tls/server/tls.key\""
+fi
+
+consul agent -node="rpc-check-$1" -data-dir=/tmp/rpc-check \
+  -bind="${POD_IP}" -serf-lan-port=18301 -http-port=18500 -dns-port=-1 \
+  -retry-join=127.0.0.1:8301 \
+  -hcl='ca_file = "/consul/tls/ca/tls.crt"' -hcl='verify_outgoing = true' \
+  ${cert_args} > /tmp/rpc-check.log 2>&1 &
+
+for i in $(seq 30); do
+  code=$(curl -s -o /dev/null -w '%{http_code}' http://127.0.0.1:18500/v1/kv/rpc-check)
+  if [ "${code}" = "404" ] || [ "${code}" = "500" ]; then
+    break
+  fi
+  sleep 1
+done
+
+consul leave -http-addr=127.0.0.1:18500 > /dev/null
+rm -rf /tmp/rpc-check
+echo "${code}"
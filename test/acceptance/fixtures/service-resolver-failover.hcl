@@ -0,0 +1,7 @@
+Kind = "service-resolver"
+Name = "static-server"
+Failover = {
+  "*" = {
+    Datacenters = ["dc2"]
+  }
+}
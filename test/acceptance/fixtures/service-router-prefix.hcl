@@ -0,0 +1,14 @@
+Kind = "service-router"
+Name = "static-server"
+Routes = [
+  {
+    Match {
+      HTTP {
+        PathPrefix = "/admin"
+      }
+    }
+    Destination {
+      Service = "static-server-admin"
+    }
+  }
+]
@@ -0,0 +1,14 @@
+Kind = "service-router"
+Name = "static-server"
+Routes = [
+  {
+    Match {
+      HTTP {
+        PathPrefix = "/"
+      }
+    }
+    Destination {
+      RequestTimeout = "2s"
+    }
+  }
+]
@@ -0,0 +1,12 @@
+Kind = "terminating-gateway"
+Name = "terminating-gateway"
+Services = [
+  {
+    Name = "external-server"
+  },
+  {
+    Name     = "external-https-server"
+    CAFile   = "/consul/userconfig/external-https-ca/ca.crt"
+    SNI      = "external-https-server"
+  }
+]
@@ -0,0 +1,36 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "global-name: every object is prefixed with global.name and selectors still match" {
+  helm_install \
+      --set 'global.name=renamed' \
+      --set 'connectInject.enabled=true' \
+      --set 'syncCatalog.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=1'
+  wait_for_ready renamed-server-0
+
+  # Every named object of the release uses the override as its prefix.
+  local names=$(kubectl get all,serviceaccounts,configmaps,roles,rolebindings,poddisruptionbudgets \
+      -l "release=$(name_prefix)" -o json | jq -r '.items[].metadata.name')
+  echo "${names}"
+  [ -n "${names}" ]
+  [ -z "$(echo "${names}" | grep -v '^renamed-')" ]
+  [ -z "$(echo "${names}" | grep "$(name_prefix)-consul")" ]
+
+  # Every Service still selects pods, so labels and selectors agree.
+  for service in $(kubectl get services -l "release=$(name_prefix)" -o jsonpath='{.items[*].metadata.name}'); do
+    local selector=$(kubectl get service ${service} -o json |
+        jq -r '.spec.selector // {} | to_entries | map("\(.key)=\(.value)") | join(",")')
+    if [ -z "${selector}" ]; then
+      continue
+    fi
+    echo "${service}: ${selector}"
+    [ -n "$(kubectl get pods -l "${selector}" -o jsonpath='{.items[*].metadata.name}')" ]
+  done
+}
@@ -0,0 +1,49 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+# agent_put makes a PUT request to the given path of the HTTP API of the
+# agent in the first server pod with the given body.
+agent_put() {
+  kubectl exec "$(name_prefix)-consul-server-0" -- \
+      curl -sSf -X PUT --data "${2:-}" "http://127.0.0.1:8500$1"
+}
+
+@test "health-checks: a TTL check follows the status it is updated to" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_leader
+
+  agent_put /v1/agent/service/register \
+      '{"Name": "ttl-test", "Port": 8080, "Check": {"CheckID": "ttl-test-check", "TTL": "10m"}}'
+
+  # TTL checks start out critical until they are first updated.
+  wait_for_health_check ttl-test ttl-test-check critical
+
+  agent_put /v1/agent/check/pass/ttl-test-check
+  wait_for_health_check ttl-test ttl-test-check passing
+
+  agent_put /v1/agent/check/warn/ttl-test-check
+  wait_for_health_check ttl-test ttl-test-check warning
+
+  agent_put /v1/agent/check/fail/ttl-test-check
+  wait_for_health_check ttl-test ttl-test-check critical
+  run assert_service_healthy ttl-test 1
+  [ "$status" -ne 0 ]
+}
+
+@test "health-checks: an injected sidecar's public listener check passes" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+
+  wait_for_health_check static-server-sidecar-proxy "Proxy Public Listener" passing
+  wait_for_health_check static-server-sidecar-proxy "Destination Alias" passing
+}
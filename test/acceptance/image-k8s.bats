@@ -0,0 +1,42 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "image-k8s: a pinned consul-k8s version is used and injects" {
+  helm_install \
+      --set 'global.imageK8S=hashicorp/consul-k8s:0.18.1' \
+      --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local injector="deploy/$(name_prefix)-consul-connect-injector-webhook-deployment"
+  [ "$(kubectl get ${injector} -o jsonpath='{.spec.template.spec.containers[0].image}')" = \
+      "hashicorp/consul-k8s:0.18.1" ]
+  [[ "$(kubectl exec ${injector} -- consul-k8s version)" =~ "v0.18.1" ]]
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  local pod=$(pod_name app=static-server)
+  [ "$(kubectl_jq '[ .spec.containers[].name ] | any(. == "envoy-sidecar")' pod ${pod})" = "true" ]
+  [ "$(kubectl_jq '.metadata.annotations["consul.hashicorp.com/connect-inject-status"]' pod ${pod})" = "injected" ]
+}
+
+@test "image-k8s: an incompatible consul-k8s version fails clearly" {
+  run helm_install \
+      --set 'global.imageK8S=hashicorp/consul-k8s:0.1.0' \
+      --set 'connectInject.enabled=true' \
+      --timeout 2m
+  [ "$status" -ne 0 ]
+
+  # The old binary can't run the injector command the chart gives it, so
+  # the injector exits instead of silently running without injecting.
+  local injector=$(pod_name "release=$(name_prefix),component=connect-injector")
+  local container=$(kubectl get pod ${injector} -o json | jq -c '.status.containerStatuses[0]')
+  echo "${container}"
+  [ "$(echo "${container}" | jq -r '.ready')" = "false" ]
+  [ "$(echo "${container}" | jq -r '.lastState.terminated.exitCode // 0')" -ne "0" ]
+}
@@ -0,0 +1,34 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "image-registry: every chart image is pulled from IMAGE_REGISTRY" {
+  skip_unless_image_registry
+
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=1'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+
+  # The app's own image isn't the chart's so only the containers added by
+  # the injector are checked in the app's pod.
+  local images=$(
+    kubectl get pods -l "release=$(name_prefix)" -o json |
+        jq -r '.items[].spec | (.initContainers // []) + .containers | .[].image'
+    kubectl get pods -l app=static-server -o json |
+        jq -r '.items[].spec | (.initContainers // []) + .containers | .[] |
+            select(.name != "static-server") | .image'
+  )
+  echo "${images}"
+  [ -n "${images}" ]
+  [ -z "$(echo "${images}" | grep -v "^${IMAGE_REGISTRY}/")" ]
+}
@@ -0,0 +1,24 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "ingress-gateway/disable: disabling gateways removes their ServiceAccount and RBAC" {
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=1'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local gateway="$(name_prefix)-consul-ingress-gateway"
+  [ "$(rbac_objects component=ingress-gateway)" = \
+      "Role/${gateway},RoleBinding/${gateway},ServiceAccount/${gateway}" ]
+
+  helm_upgrade_reset --set 'connectInject.enabled=true'
+
+  # No orphaned identity or privileges are left behind.
+  [ "$(rbac_objects component=ingress-gateway)" = "" ]
+}
@@ -0,0 +1,40 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "ingress-gateway/drain: scaling in doesn't fail requests through the gateway" {
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=2'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  config_write "${BATS_TEST_DIRNAME}/fixtures/ingress-gateway.hcl"
+  wait_for_ingress_listener "$(pod_name "release=$(name_prefix),component=ingress-gateway")" 8080 tcp
+
+  local url="http://$(name_prefix)-consul-ingress-gateway:8080"
+  retry_with_backoff 1 8 10 kubectl exec "$(name_prefix)-consul-server-0" -- curl -sSf "${url}"
+
+  # Send steady traffic through the gateway for 30 seconds while one of the
+  # two replicas is removed, recording every request that fails.
+  local results="${BATS_TMPDIR}/ingress-gateway-drain"
+  kubectl exec "$(name_prefix)-consul-server-0" -- sh -c \
+      'for i in $(seq 60); do curl -sSf -m 2 -o /dev/null "$0" || echo failed; sleep 0.5; done' \
+      "${url}" > "${results}" &
+  local traffic=$!
+
+  sleep 5
+  kubectl scale "deploy/$(name_prefix)-consul-ingress-gateway" --replicas=1
+  wait_for_pods "release=$(name_prefix),component=ingress-gateway" 1
+  wait ${traffic}
+
+  cat "${results}"
+  [ "$(grep -c failed "${results}")" -eq "0" ]
+}
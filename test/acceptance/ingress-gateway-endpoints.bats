@@ -0,0 +1,29 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "ingress-gateway/endpoints: the service only routes to ready gateways" {
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=2'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local service="$(name_prefix)-consul-ingress-gateway"
+  assert_service_endpoints_ready ${service} component=ingress-gateway
+  [ "$(service_endpoints ${service} | tr ',' '\n' | wc -l)" -eq "2" ]
+
+  # Stopping Envoy fails the gateway's readiness probe until the container
+  # has been restarted.
+  local pod=$(pod_name "release=$(name_prefix),component=ingress-gateway")
+  local ip=$(kubectl get pod ${pod} -o jsonpath='{.status.podIP}')
+  kubectl exec ${pod} -c ingress-gateway -- wget -qO- --post-data= http://127.0.0.1:19000/quitquitquit || true
+  kubectl wait --for=condition=Ready=false --timeout=$(scaled_timeout 60)s pod/${pod}
+
+  assert_service_endpoints_ready ${service} component=ingress-gateway
+  [[ ! "$(service_endpoints ${service})" =~ "${ip}" ]]
+}
@@ -0,0 +1,31 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "ingress-gateway/load-balancer: the gateway is reachable on its external address" {
+  skip_unless_load_balancer
+
+  helm_install \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=1' \
+      --set 'ingressGateways.defaults.service.type=LoadBalancer'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  config_write "${BATS_TEST_DIRNAME}/fixtures/ingress-gateway.hcl"
+  wait_for_ingress_listener "$(pod_name "release=$(name_prefix),component=ingress-gateway")" 8080 tcp
+
+  # The request is made from where the tests run rather than from a pod.
+  local address
+  address=$(gateway_external_address "$(name_prefix)-consul-ingress-gateway" 8080)
+  local response
+  response=$(retry_with_backoff 1 8 10 curl -sSf -m 5 "http://${address}")
+  [[ "${response}" =~ "hello world" ]]
+}
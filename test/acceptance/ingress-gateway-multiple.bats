@@ -0,0 +1,26 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "ingress-gateway/multiple: gateways are configured from a values file" {
+  helm_install \
+      -f "${BATS_TEST_DIRNAME}/fixtures/ingress-gateway-multiple-values.yaml" \
+      --set 'ingressGateways.defaults.replicas=3'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local prefix="$(name_prefix)-consul"
+
+  # --set takes precedence over the defaults in the values file but not
+  # over the value set for a specific gateway.
+  wait_for_pods "ingress-gateway-name=${prefix}-ingress-gateway" 3
+  wait_for_pods "ingress-gateway-name=${prefix}-other-ingress-gateway" 2
+  [ "$(kubectl get svc ${prefix}-other-ingress-gateway -o jsonpath='{.spec.ports[*].port}')" = "8080 8443" ]
+
+  for service in ingress-gateway other-ingress-gateway; do
+    [ "$(consul_api /v1/catalog/service/${service} | jq -r '.[0].ServiceKind')" = "ingress-gateway" ]
+  done
+}
@@ -0,0 +1,51 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+# install_gateway_on_443 installs an ingress gateway with a listener on port
+# 443 routing to static-server.
+install_gateway_on_443() {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/ingress-gateway-privileged-port-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  config_write "${BATS_TEST_DIRNAME}/fixtures/ingress-gateway-443.hcl"
+}
+
+# gateway_curl curls the ingress gateway's service on port 443 from the
+# first server pod, retrying while the listener is being configured.
+gateway_curl() {
+  retry_with_backoff 1 8 10 kubectl exec "$(name_prefix)-consul-server-0" -- \
+      curl -sSf "http://$(name_prefix)-consul-ingress-gateway:443"
+}
+
+@test "ingress-gateway/privileged-port: the gateway binds and routes port 443" {
+  install_gateway_on_443
+
+  [[ "$(gateway_curl)" =~ "hello world" ]]
+}
+
+@test "ingress-gateway/privileged-port: the listener fails to bind without the privileges to" {
+  install_gateway_on_443
+
+  # Running Envoy as a non-root user without NET_BIND_SERVICE takes away
+  # the privilege to bind ports below 1024.
+  local deployment="$(name_prefix)-consul-ingress-gateway"
+  kubectl patch deployment "${deployment}" --type=json -p '[{
+    "op": "add",
+    "path": "/spec/template/spec/containers/0/securityContext",
+    "value": {"runAsUser": 100, "runAsNonRoot": true, "capabilities": {"drop": ["ALL"]}}
+  }]'
+  kubectl rollout status --timeout=$(scaled_timeout 120)s "deploy/${deployment}"
+
+  run gateway_curl
+  [ "$status" -ne 0 ]
+  local logs=$(kubectl logs "deploy/${deployment}" -c ingress-gateway)
+  [[ "${logs}" =~ "Permission denied" ]]
+}
@@ -0,0 +1,28 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "install-invalid-values: ingress gateways require connect-inject" {
+  assert_install_fails "connectInject.enabled must be true" \
+      --set 'ingressGateways.enabled=true' \
+      --set 'connectInject.enabled=false'
+  run helm status "$(name_prefix)"
+  [ "$status" -ne 0 ]
+}
+
+@test "install-invalid-values: ingress gateway names must be unique" {
+  assert_install_fails "Ingress gateway names must be unique" \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.gateways[0].name=gateway' \
+      --set 'ingressGateways.gateways[1].name=gateway'
+}
+
+@test "install-invalid-values: auto-encrypt requires TLS" {
+  assert_install_fails "global.tls.enabled must be true if global.tls.enableAutoEncrypt is true" \
+      --set 'global.tls.enableAutoEncrypt=true'
+}
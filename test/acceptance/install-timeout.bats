@@ -0,0 +1,35 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "install-timeout: a failed install reports why pods aren't ready" {
+  # No node has this much CPU so the servers can never be scheduled.
+  run helm_install \
+      --set 'server.resources.requests.cpu=1000' \
+      --set 'server.resources.limits.cpu=1000' \
+      --timeout 1m
+  echo "${output}"
+  [ "$status" -ne 0 ]
+
+  [[ "${output}" =~ "Pods of release $(name_prefix) that are not ready:" ]]
+  [[ "${output}" =~ "$(name_prefix)-consul-server-0: Pending, Unschedulable:" ]]
+  [[ "${output}" =~ "Insufficient cpu" ]]
+}
+
+@test "install-timeout: with HELM_ATOMIC a failed install is deleted" {
+  HELM_ATOMIC=true run helm_install \
+      --set 'server.resources.requests.cpu=1000' \
+      --set 'server.resources.limits.cpu=1000' \
+      --timeout 1m
+  echo "${output}"
+  [ "$status" -ne 0 ]
+
+  [[ "${output}" =~ "Diagnostics written to" ]]
+  [[ "${output}" =~ "Deleting the failed release $(name_prefix)" ]]
+  run helm status "$(name_prefix)"
+  [ "$status" -ne 0 ]
+}
@@ -0,0 +1,58 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+# These tests run a single datacenter across two Kubernetes clusters: the
+# servers and a set of clients in the current context and only clients in
+# the secondary cluster, see skip_unless_secondary_cluster. The clusters
+# must share a flat pod network since the clients gossip with the servers
+# and the sidecars connect to each other by pod IP.
+
+teardown() {
+  rm -f "${BATS_TMPDIR}/multi-cluster-values.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  if [ -n "${SECONDARY_KUBECONTEXT}" ]; then
+    secondary_kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+    helm_delete_secondary
+  fi
+  helm_delete
+}
+
+@test "multi-cluster: services are reachable from clients in another Kubernetes cluster" {
+  skip_unless_secondary_cluster
+
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  cat > "${BATS_TMPDIR}/multi-cluster-values.yaml" <<EOT
+server:
+  enabled: false
+client:
+  join:
+$(kubectl get pods -l "release=$(name_prefix),component=server" \
+    -o jsonpath='{range .items[*]}    - {.status.podIP}{"\n"}{end}')
+connectInject:
+  enabled: true
+EOT
+  helm_install_secondary -f "${BATS_TMPDIR}/multi-cluster-values.yaml"
+
+  # The secondary cluster's clients are members of the same datacenter.
+  local nodes=$(secondary_kubectl get pods -l "release=$(name_prefix),component=client" \
+      -o jsonpath='{.items[*].spec.nodeName}')
+  for node in ${nodes}; do
+    [ "$(consul_api /v1/catalog/node/${node} | jq -r '.Node.Datacenter')" = "dc1" ]
+  done
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  secondary_kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  secondary_kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(secondary_kubectl get pods -l app=static-client -o jsonpath='{.items[0].metadata.name}')
+  local response=""
+  for i in $(seq 30); do
+    response=$(secondary_kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234) && break
+    sleep 2
+  done
+  [[ "${response}" =~ "hello world" ]]
+}
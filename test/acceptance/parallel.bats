@@ -0,0 +1,31 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  RELEASE_NAME=consul-a helm_delete
+  RELEASE_NAME=consul-b helm_delete
+}
+
+# Consul clients use hostPorts so only one release per Kubernetes cluster
+# can run clients (and therefore gateways or connect-inject). Server-only
+# releases share nothing and can be installed concurrently.
+@test "parallel: server-only releases can be installed concurrently without interference" {
+  RELEASE_NAME=consul-a helm_install --set 'client.enabled=false' &
+  local pid_a=$!
+  RELEASE_NAME=consul-b helm_install --set 'client.enabled=false' &
+  local pid_b=$!
+
+  wait ${pid_a}
+  wait ${pid_b}
+
+  for release in consul-a consul-b; do
+    RELEASE_NAME=${release} wait_for_ready ${release}-consul-server-0
+
+    # Each release only knows about its own servers.
+    local members=$(kubectl exec "${release}-consul-server-0" -- consul members)
+    echo "${members}"
+    [ "$(echo "${members}" | grep -c server)" -eq "3" ]
+    [ "$(echo "${members}" | grep -c "${release}-consul-server")" -eq "3" ]
+  done
+}
@@ -0,0 +1,60 @@
+#!/usr/bin/env bats
+
+# These tests always run in a namespace of their own, see
+# NAMESPACE_PER_TEST in CONTRIBUTING.md, so that the Pod Security Admission
+# labels they put on it don't affect anything else.
+NAMESPACE_PER_TEST=true
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+# enforce_pod_security creates the test's namespace and enforces the given
+# Pod Security Admission level in it.
+enforce_pod_security() {
+  use_test_namespace
+  kubectl label namespace "${TEST_NAMESPACE}" "pod-security.kubernetes.io/enforce=$1"
+}
+
+@test "pod-security: the chart's pods are rejected by the restricted level" {
+  enforce_pod_security restricted
+
+  run helm_install --timeout 2m --set 'client.enabled=false'
+  [ "$status" -ne 0 ]
+
+  # The failure is down to Pod Security Admission, as documented in the
+  # README, rather than anything else.
+  local events=$(kubectl get events -o jsonpath='{.items[*].message}')
+  echo "${events}"
+  [[ "${events}" =~ 'violates PodSecurity "restricted' ]]
+}
+
+@test "pod-security: servers run under the baseline level" {
+  enforce_pod_security baseline
+
+  helm_install --set 'client.enabled=false'
+  [ "$(kubectl get statefulset "$(name_prefix)-consul-server" \
+      -o jsonpath='{.status.readyReplicas}')" = "3" ]
+}
+
+@test "pod-security: clients are rejected by the baseline level" {
+  enforce_pod_security baseline
+
+  run helm_install --timeout 2m
+  [ "$status" -ne 0 ]
+
+  local events=$(kubectl get events -o jsonpath='{.items[*].message}')
+  echo "${events}"
+  [[ "${events}" =~ 'violates PodSecurity "baseline' ]]
+}
+
+@test "pod-security: components run with the configured resources" {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/resources-values.yaml"
+
+  local expected=(requests.memory=150Mi requests.cpu=150m limits.memory=200Mi limits.cpu=200m)
+  assert_pod_security "release=$(name_prefix),component=server" --container consul "${expected[@]}"
+  assert_pod_security "release=$(name_prefix),component=client" --container consul "${expected[@]}"
+  assert_pod_security "release=$(name_prefix),component=ingress-gateway" --container ingress-gateway "${expected[@]}"
+}
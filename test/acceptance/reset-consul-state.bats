@@ -0,0 +1,34 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "reset-consul-state: config entries, intentions and KV data are deleted" {
+  helm_install \
+      -f "${BATS_TEST_DIRNAME}/fixtures/proxy-defaults-values.yaml" \
+      --set 'global.acls.manageSystemACLs=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  local CONSUL_HTTP_TOKEN
+  CONSUL_HTTP_TOKEN=$(acl_bootstrap_token)
+  local tokens=$(consul_api /v1/acl/tokens | jq -r '[ .[].AccessorID ] | sort | join(",")')
+
+  # These are written directly rather than with config_write and kv_put,
+  # whose cleanups don't use the token.
+  echo '{"Kind": "service-defaults", "Name": "static-server", "Protocol": "http"}' |
+      consul_api_put /v1/config
+  consul_exec intention create -deny static-client static-server
+  consul_exec kv put reset/nested/key value
+  consul_exec kv put reset-top value
+
+  # The token is taken from the release when it isn't set.
+  CONSUL_HTTP_TOKEN= reset_consul_state
+
+  [ "$(consul_api /v1/config/service-defaults | jq length)" = "0" ]
+  [ "$(consul_api /v1/connect/intentions | jq length)" = "0" ]
+  [ -z "$(consul_exec kv get -keys)" ]
+  [ "$(consul_api /v1/config/proxy-defaults/global | jq -r .Name)" = "global" ]
+  [ "$(consul_api /v1/acl/tokens | jq -r '[ .[].AccessorID ] | sort | join(",")')" = "${tokens}" ]
+}
@@ -0,0 +1,30 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/ACLs: the server-acl-init job is deleted after it completes" {
+  helm_install --set 'global.acls.manageSystemACLs=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # The cleanup hook deletes the completed job and then itself.
+  assert_job_deleted "$(name_prefix)-consul-server-acl-init"
+  assert_job_deleted "$(name_prefix)-consul-server-acl-init-cleanup"
+
+  # Job specs are immutable so an upgrade that changes the job's arguments
+  # only succeeds because the old job is gone.
+  helm_upgrade \
+      --set 'global.acls.manageSystemACLs=true' \
+      --set 'global.acls.createReplicationToken=true'
+  assert_job_deleted "$(name_prefix)-consul-server-acl-init"
+  assert_job_deleted "$(name_prefix)-consul-server-acl-init-cleanup"
+  kubectl get secret "$(name_prefix)-consul-acl-replication-acl-token"
+
+  # The rerun kept the original bootstrap token.
+  local token
+  token=$(acl_bootstrap_token)
+  [ "$(CONSUL_HTTP_TOKEN="${token}" consul_api /v1/acl/token/self | jq -r '.Policies[0].Name')" = "global-management" ]
+}
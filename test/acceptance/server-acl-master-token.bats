@@ -0,0 +1,38 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  rm -f "${BATS_TMPDIR}/master-token-values.yaml"
+  helm_delete
+}
+
+@test "server/ACLs: a master token set in the server config is used instead of bootstrapping" {
+  local token=$(cat /proc/sys/kernel/random/uuid)
+  create_secret consul-master-token token="${token}"
+
+  # The servers create the master token from their config, and
+  # server-acl-init is given the same token so it doesn't bootstrap.
+  cat > "${BATS_TMPDIR}/master-token-values.yaml" <<EOT
+global:
+  acls:
+    manageSystemACLs: true
+    bootstrapToken:
+      secretName: consul-master-token
+      secretKey: token
+server:
+  extraConfig: |
+    {"acl": {"tokens": {"master": "${token}"}}}
+EOT
+  helm_install -f "${BATS_TMPDIR}/master-token-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+  kubectl wait --for=condition=complete --timeout=$(scaled_timeout 120)s "job/$(name_prefix)-consul-server-acl-init"
+
+  # The master token works for management operations...
+  [ "$(CONSUL_HTTP_TOKEN="${token}" consul_api /v1/acl/token/self | jq -r '.Description')" = "Master Token" ]
+
+  # ...and is the only management token, so no bootstrap happened.
+  local tokens=$(CONSUL_HTTP_TOKEN="${token}" consul_api /v1/acl/tokens)
+  echo "${tokens}"
+  [ "$(echo "${tokens}" | jq '[ .[] | select(.Description | test("Bootstrap Token")) ] | length')" -eq "0" ]
+}
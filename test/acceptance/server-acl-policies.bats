@@ -0,0 +1,83 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+# component_token outputs the ACL token the chart created for the given
+# component, e.g. "client" or "mesh-gateway".
+component_token() {
+  kubectl get secret "$(name_prefix)-consul-$1-acl-token" -o jsonpath='{.data.token}' |
+      base64 --decode
+}
+
+# component_rules outputs the rules of every policy attached to the given
+# component's ACL token.
+component_rules() {
+  local bootstrap_token
+  bootstrap_token=$(acl_bootstrap_token)
+
+  local policy_ids=$(CONSUL_HTTP_TOKEN="$(component_token $1)" consul_api /v1/acl/token/self |
+      jq -r '.Policies[].ID')
+  for id in ${policy_ids}; do
+    CONSUL_HTTP_TOKEN="${bootstrap_token}" consul_api "/v1/acl/policy/${id}" | jq -r '.Rules'
+  done
+}
+
+# kv_put_as writes a KV entry using the given component's token.
+kv_put_as() {
+  kubectl exec "$(name_prefix)-consul-server-0" -- \
+      env CONSUL_HTTP_TOKEN="$(component_token $1)" consul kv put "acl-scope/$1" value
+}
+
+@test "server/ACLs: component tokens are scoped to least privilege" {
+  helm_install \
+      --set 'global.acls.manageSystemACLs=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'meshGateway.enabled=true' \
+      --set 'meshGateway.service.type=ClusterIP'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # Clients may register nodes but can't touch KV, ACLs or operator APIs.
+  local rules=$(component_rules client)
+  echo "${rules}"
+  [[ "${rules}" =~ 'node_prefix ""' ]]
+  [[ ! "${rules}" =~ "key" ]]
+  [[ ! "${rules}" =~ "acl" ]]
+  [[ ! "${rules}" =~ 'operator = "write"' ]]
+
+  # The mesh gateway may only write its own service.
+  local rules=$(component_rules mesh-gateway)
+  echo "${rules}"
+  [[ "${rules}" =~ 'service "mesh-gateway"' ]]
+  [[ ! "${rules}" =~ "key" ]]
+  [[ ! "${rules}" =~ "acl" ]]
+  [[ ! "${rules}" =~ 'operator = "write"' ]]
+
+  # Confirm the missing KV permissions are enforced.
+  run kv_put_as client
+  [ "$status" -ne 0 ]
+  [[ "$output" =~ "Permission denied" ]]
+
+  run kv_put_as mesh-gateway
+  [ "$status" -ne 0 ]
+  [[ "$output" =~ "Permission denied" ]]
+}
+
+@test "server/ACLs: the ingress gateway's token may write its own service" {
+  helm_install \
+      --set 'global.acls.manageSystemACLs=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=1'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # server-acl-init names the policy and the token after the gateway.
+  local policy="ingress-gateway-ingress-gateway-token"
+  assert_acl_policy "${policy}" \
+      'service "ingress-gateway"' \
+      'policy = "write"'
+  assert_token_has_policy "${policy}" "${policy}"
+}
@@ -0,0 +1,40 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/agent-config: defaults" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  [ "$(agent_config .Datacenter)" = "dc1" ]
+  [ "$(agent_config .ServerMode)" = "true" ]
+  [ "$(agent_config .BootstrapExpect)" = "3" ]
+  [ "$(agent_config .ACLsEnabled)" = "false" ]
+  [ "$(agent_config .VerifyOutgoing)" = "false" ]
+  [ "$(agent_config .EncryptKey)" = "" ]
+}
+
+@test "server/agent-config: TLS, ACL and gossip encryption values are applied" {
+  create_secret consul-gossip-encryption-key key="$(openssl rand -base64 32)"
+  helm_install \
+      --set 'global.datacenter=dc2' \
+      --set 'global.tls.enabled=true' \
+      --set 'global.acls.manageSystemACLs=true' \
+      --set 'global.gossipEncryption.secretName=consul-gossip-encryption-key' \
+      --set 'global.gossipEncryption.secretKey=key'
+  wait_for_ready $(name_prefix)-consul-server-0
+  local CONSUL_HTTP_TOKEN
+  CONSUL_HTTP_TOKEN=$(acl_bootstrap_token)
+
+  [ "$(agent_config .Datacenter)" = "dc2" ]
+  [ "$(agent_config .ACLsEnabled)" = "true" ]
+  [ "$(agent_config .ACLDefaultPolicy)" = "deny" ]
+  [ "$(agent_config .VerifyOutgoing)" = "true" ]
+  [ "$(agent_config .VerifyServerHostname)" = "true" ]
+  [ "$(agent_config .VerifyIncomingRPC)" = "true" ]
+  [ "$(agent_config .EncryptKey)" = "hidden" ]
+}
@@ -0,0 +1,37 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/audit-log: enterprise audit events are written to the file sink" {
+  helm_install_enterprise -f "${BATS_TEST_DIRNAME}/fixtures/audit-log-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # Generate an HTTP request that the audit log should record.
+  consul_exec kv put audit/test value
+
+  assert_audit_log_contains "$(name_prefix)-consul-server-0" \
+      '.payload.request.endpoint == "/v1/kv/audit/test"'
+}
+
+@test "server/audit-log: ACL token creation is recorded with who made it" {
+  helm_install_enterprise \
+      -f "${BATS_TEST_DIRNAME}/fixtures/audit-log-values.yaml" \
+      --set 'global.acls.manageSystemACLs=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  local CONSUL_HTTP_TOKEN
+  CONSUL_HTTP_TOKEN=$(acl_bootstrap_token)
+
+  consul_exec acl token create -description "audited token"
+
+  # The event carries the accessor of the token that made the request.
+  local accessor=$(consul_exec acl token read -self -format=json | jq -r .AccessorID)
+  assert_audit_log_contains "$(name_prefix)-consul-server-0" "
+      .payload.type == \"HTTPEvent\" and
+      .payload.request.endpoint == \"/v1/acl/token\" and
+      .payload.request.operation == \"PUT\" and
+      .payload.auth.accessor_id == \"${accessor}\""
+}
@@ -0,0 +1,63 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/bad-image: an upgrade to a broken image halts without losing quorum" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_leader
+
+  local statefulset="statefulset/$(name_prefix)-consul-server"
+  local revision=$(kubectl get ${statefulset} -o jsonpath='{.status.currentRevision}')
+
+  # The busybox image has no consul binary so the server container exits
+  # as soon as it starts.
+  run helm_upgrade --set 'server.image=busybox:1.31' --timeout 2m
+  [ "$status" -ne 0 ]
+
+  # The StatefulSet replaces the highest ordinal first and doesn't move on
+  # while it isn't ready, so the other servers keep running the old
+  # revision and still have a leader.
+  local broken="$(name_prefix)-consul-server-2"
+  [ "$(kubectl get pod ${broken} -o jsonpath='{.spec.containers[0].image}')" = "busybox:1.31" ]
+  [ "$(kubectl get pod ${broken} -o jsonpath='{.status.containerStatuses[0].ready}')" = "false" ]
+  for i in 0 1; do
+    local pod="$(name_prefix)-consul-server-${i}"
+    [ "$(kubectl get pod ${pod} -o jsonpath='{.metadata.labels.controller-revision-hash}')" = "${revision}" ]
+    [ "$(kubectl get pod ${pod} -o jsonpath='{.status.containerStatuses[0].ready}')" = "true" ]
+  done
+  wait_for_leader
+
+  # Rolling back doesn't replace a pod that never became ready, see
+  # "Forced rollback" in the StatefulSet docs, so the upgrade can't finish
+  # until the broken pod is deleted and recreated from the old revision.
+  run helm_upgrade --timeout 1m
+  kubectl delete pod ${broken}
+  wait_for_pods "release=$(name_prefix),component=server" 3 300
+  wait_for_leader
+  [ "$(consul_exec operator raft list-peers |
+      awk '$5 == "true"' | wc -l)" -eq "3" ]
+}
+
+@test "server/bad-image: with HELM_ATOMIC a failed upgrade is rolled back" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  HELM_ATOMIC=true run helm_upgrade --set 'server.image=busybox:1.31' --timeout 2m
+  echo "${output}"
+  [ "$status" -ne 0 ]
+  [[ "${output}" =~ "Rolling back the failed upgrade of $(name_prefix)" ]]
+
+  # The rollback is the release's third revision, with the first's values.
+  assert_release_deployed 3
+  [ "$(release_values | yq -r '.server.image')" = "null" ]
+  [ "$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.spec.template.spec.containers[0].image}')" != "busybox:1.31" ]
+
+  # The broken pod is only replaced once it is deleted, see above.
+  kubectl delete pod "$(name_prefix)-consul-server-2"
+  wait_for_pods "release=$(name_prefix),component=server" 3 300
+}
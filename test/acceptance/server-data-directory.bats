@@ -0,0 +1,22 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/data-directory: state in a custom data directory survives restarts" {
+  helm_install --set 'server.dataDirectory=/consul/state'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kv_put data-directory/test value
+  kubectl exec "$(name_prefix)-consul-server-0" -- test -d /consul/state/raft
+
+  # Restart every server so the only copy of the state is on the volumes.
+  kubectl delete pods -l "release=$(name_prefix),component=server" --wait
+  kubectl rollout status --timeout=$(scaled_timeout 300)s "statefulset/$(name_prefix)-consul-server"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  assert_kv data-directory/test value
+}
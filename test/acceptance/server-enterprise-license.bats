@@ -0,0 +1,24 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/enterprise-license: the license from CONSUL_ENT_LICENSE_PATH is applied" {
+  skip_unless_enterprise
+  if [ -z "${CONSUL_ENT_LICENSE_PATH}" ]; then
+    skip "requires a Consul Enterprise license, set CONSUL_ENT_LICENSE_PATH to it"
+  fi
+
+  # The license job is a post-install hook, so the install fails unless it
+  # completed.
+  helm_install_enterprise
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local license
+  license=$(consul_exec license get)
+  echo "${license}"
+  [[ "${license}" =~ "License ID" ]]
+}
@@ -0,0 +1,28 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/gossip-encryption: gossip isn't encrypted by default" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  run assert_gossip_encrypted
+  echo "${output}"
+  [ "$status" -ne 0 ]
+}
+
+@test "server/gossip-encryption: every member uses the key from the secret" {
+  local key=$(openssl rand -base64 32)
+  create_secret consul-gossip-encryption-key key="${key}"
+  helm_install \
+      --set 'global.acls.manageSystemACLs=true' \
+      --set 'global.gossipEncryption.secretName=consul-gossip-encryption-key' \
+      --set 'global.gossipEncryption.secretKey=key'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  assert_gossip_encrypted "${key}"
+}
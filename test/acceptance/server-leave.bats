@@ -0,0 +1,36 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+# server_member_status waits for the given server to stop being "alive"
+# (from the point of view of the first server) and outputs its status,
+# "left" after a graceful leave.
+server_member_status() {
+  local status
+  for i in $(seq 30); do
+    status=$(consul_exec members |
+        awk -v name="$1" '$1 == name { print $3 }')
+    if [ "${status}" != "alive" ]; then
+      echo "${status}"
+      return
+    fi
+    sleep 1
+  done
+  echo "${status}"
+}
+
+@test "server/leave: servers leave gracefully within terminationGracePeriodSeconds" {
+  helm_install --set 'server.terminationGracePeriodSeconds=60'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl delete pod "$(name_prefix)-consul-server-2"
+  [ "$(server_member_status $(name_prefix)-consul-server-2)" = "left" ]
+
+  # Once replaced there is no stale peer left in the raft configuration.
+  wait_for_ready $(name_prefix)-consul-server-2
+  wait_for_raft_healthy 3
+}
@@ -0,0 +1,38 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/metrics: the leader exposes raft and autopilot metrics" {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/prometheus-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  assert_server_metrics "$(server_leader)" \
+      consul_autopilot_healthy \
+      consul_autopilot_failure_tolerance \
+      consul_raft_leader_lastContact \
+      consul_raft_apply
+}
+
+@test "server/metrics: Prometheus metrics are served when prometheus_retention_time is set" {
+  helm_install -f "${BATS_TEST_DIRNAME}/fixtures/prometheus-values.yaml"
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local metrics=$(scrape_metrics "$(name_prefix)-consul-server-0" consul 8500 \
+      "/v1/agent/metrics?format=prometheus")
+  [ -n "$(echo "${metrics}" | grep '^consul_')" ]
+  [ "$(echo "${metrics}" | metric_value consul_raft_state_leader)" -ge 1 ]
+}
+
+@test "server/metrics: Prometheus metrics aren't served without prometheus_retention_time" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # Consul rejects the request when its Prometheus sink isn't enabled.
+  local metrics=$(kubectl exec "$(name_prefix)-consul-server-0" -- \
+      curl -sS "http://127.0.0.1:8500/v1/agent/metrics?format=prometheus")
+  [ -z "$(echo "${metrics}" | grep '^consul_')" ]
+}
@@ -0,0 +1,52 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+  kubectl delete --ignore-not-found configmap server-reload-config
+}
+
+# server_config_file outputs the contents of the reloadable config file
+# mounted into the first server pod.
+server_config_file() {
+  kubectl exec "$(name_prefix)-consul-server-0" -- \
+      cat /consul/userconfig/server-reload-config/config.json
+}
+
+@test "server/reload: reloadable config changes apply via SIGHUP without a restart" {
+  # Config loaded from extraVolumes isn't part of the pod template, so
+  # changing it doesn't roll the StatefulSet like server.extraConfig does.
+  use_test_namespace
+  kubectl create configmap server-reload-config \
+      --from-literal='config.json={"log_level": "INFO"}'
+
+  helm_install \
+      --set 'server.extraVolumes[0].type=configMap' \
+      --set 'server.extraVolumes[0].name=server-reload-config' \
+      --set 'server.extraVolumes[0].load=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local uid=$(kubectl get pod "$(name_prefix)-consul-server-0" -o jsonpath='{.metadata.uid}')
+  [ "$(agent_config .LogLevel)" = "INFO" ]
+
+  kubectl create configmap server-reload-config \
+      --from-literal='config.json={"log_level": "DEBUG"}' \
+      --dry-run=client -o yaml | kubectl apply -f -
+
+  # The kubelet syncs ConfigMap volumes periodically so wait for the new
+  # contents to land in the pod before reloading.
+  for i in $(seq 60); do
+    if server_config_file | grep -q DEBUG; then
+      break
+    fi
+    echo "Waiting for updated config to be mounted..."
+    sleep 2
+  done
+  server_config_file | grep -q DEBUG
+
+  consul_exec reload
+
+  [ "$(agent_config .LogLevel)" = "DEBUG" ]
+  [ "$(kubectl get pod "$(name_prefix)-consul-server-0" -o jsonpath='{.metadata.uid}')" = "${uid}" ]
+}
@@ -0,0 +1,56 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  rm -f "${BATS_TMPDIR}/rolling-upgrade-values.yaml"
+  helm_delete
+}
+
+# has_leader succeeds if autopilot reports a leader, asking through a client
+# agent since the servers themselves are being rolled.
+has_leader() {
+  kubectl exec "$1" -- curl -sS --max-time 5 http://127.0.0.1:8500/v1/operator/autopilot/health |
+      jq -e '[ .Servers[] | select(.Leader) ] | length == 1' > /dev/null 2>&1
+}
+
+@test "server/rolling-upgrade: the servers keep quorum while they are rolled" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_raft_healthy 3
+
+  # A change to the servers' config rolls them one at a time.
+  cat > "${BATS_TMPDIR}/rolling-upgrade-values.yaml" <<EOT
+server:
+  extraConfig: |
+    {"log_level": "DEBUG"}
+EOT
+  local log="${BATS_TMPDIR}/rolling-upgrade-$(name_prefix).log"
+  helm_upgrade -f "${BATS_TMPDIR}/rolling-upgrade-values.yaml" > "${log}" 2>&1 3>&- &
+  local upgrade=$!
+
+  # Only an election, after the leader is rolled, may leave the servers
+  # without a leader, which takes seconds. Losing quorum would take until
+  # the next server is back.
+  local client=$(pod_name "release=$(name_prefix),component=client")
+  local leaderless=0 longest=0
+  while kill -0 ${upgrade} 2> /dev/null; do
+    if has_leader ${client}; then
+      leaderless=0
+    else
+      leaderless=$((leaderless + 1))
+      [ "${leaderless}" -gt "${longest}" ] && longest=${leaderless}
+    fi
+    sleep 2
+  done
+  local status=0
+  wait ${upgrade} || status=$?
+  cat "${log}"
+  rm -f "${log}"
+  [ "${status}" -eq 0 ]
+
+  echo "The servers were without a leader for at most ${longest} checks in a row"
+  [ "${longest}" -le 5 ]
+  wait_for_raft_healthy 3
+  [ "$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.status.updatedReplicas}')" = "3" ]
+}
@@ -0,0 +1,30 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/scale: scaling up from 3 to 5 servers keeps the data" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_raft_healthy 3
+  kv_put scale/test before
+
+  # The servers' retry-join addresses change with the number of servers,
+  # so the existing servers are rolled as well as the new ones added.
+  scale_servers 5
+  [ "$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.status.readyReplicas}')" = "5" ]
+  [ -n "$(server_leader)" ]
+  assert_kv scale/test before
+}
+
+@test "server/scale: scaling down from 5 to 3 servers leaves healthy voters" {
+  helm_install --set 'server.replicas=5'
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_raft_healthy 5
+
+  scale_servers 3
+  [ "$(kubectl exec "$(name_prefix)-consul-server-0" -- consul operator raft list-peers | tail -n +2 | wc -l | tr -d ' ')" = "3" ]
+}
@@ -0,0 +1,26 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/secrets: servers use no secrets by default" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  assert_pod_secrets $(name_prefix)-consul-server-0 ""
+}
+
+@test "server/secrets: servers only use the gossip key and their TLS secrets" {
+  create_secret consul-gossip-encryption-key key="$(openssl rand -base64 32)"
+  helm_install \
+      --set 'global.tls.enabled=true' \
+      --set 'global.gossipEncryption.secretName=consul-gossip-encryption-key' \
+      --set 'global.gossipEncryption.secretKey=key'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  assert_pod_secrets $(name_prefix)-consul-server-0 \
+      "$(name_prefix)-consul-ca-cert,$(name_prefix)-consul-server-cert,consul-gossip-encryption-key"
+}
@@ -0,0 +1,53 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/services: headless and UI services are created" {
+  helm_install --set 'ui.service.type=ClusterIP'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # The headless service gives each server a stable DNS name.
+  local server=$(kubectl get service "$(name_prefix)-consul-server" -o json)
+  [ "$(echo "${server}" | jq -r '.spec.clusterIP')" = "None" ]
+  [ "$(echo "${server}" | jq -r '.spec.publishNotReadyAddresses')" = "true" ]
+  [ "$(echo "${server}" | jq -r '[ .spec.ports[].name ] | sort | join(",")')" = \
+      "dns-tcp,dns-udp,http,serflan-tcp,serflan-udp,serfwan-tcp,serfwan-udp,server" ]
+
+  # The UI service is load balanced across the servers.
+  local ui=$(kubectl get service "$(name_prefix)-consul-ui" -o json)
+  [ "$(echo "${ui}" | jq -r '.spec.type')" = "ClusterIP" ]
+  [ "$(echo "${ui}" | jq -r '.spec.clusterIP')" != "None" ]
+  [ "$(echo "${ui}" | jq -r '.spec.ports[0].port')" = "80" ]
+  [ "$(echo "${ui}" | jq -r '.spec.ports[0].targetPort')" = "8500" ]
+}
+
+@test "server/services: the headless service resolves individual servers" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  for i in 0 1 2; do
+    local name="$(name_prefix)-consul-server-${i}.$(name_prefix)-consul-server"
+    local ip=$(kubectl get pod "$(name_prefix)-consul-server-${i}" -o jsonpath='{.status.podIP}')
+    local resolved=$(kubectl exec "$(name_prefix)-consul-server-0" -- nslookup "${name}")
+    echo "${resolved}"
+    [[ "${resolved}" =~ "${ip}" ]]
+  done
+}
+
+@test "server/services: the HTTP API can be reached from the test through a port forward" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  port_forward "svc/$(name_prefix)-consul-ui" 18500 80
+  [ -n "$(CONSUL_API_LOCAL_PORT=18500 consul_api /v1/status/leader)" ]
+
+  # A forward that has gone away fails clearly instead of hanging.
+  stop_port_forward 18500
+  CONSUL_API_LOCAL_PORT=18500 run consul_api /v1/status/leader
+  [ "$status" -ne 0 ]
+  [[ "$output" =~ "is not running" ]]
+}
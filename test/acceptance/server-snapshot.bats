@@ -0,0 +1,42 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  rm -f "${BATS_TMPDIR}/consul.snap"
+  helm_delete
+}
+
+@test "server/snapshot: state is recovered by restoring a snapshot onto fresh servers" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  consul_exec kv put snapshot/test value
+  consul_snapshot_save "${BATS_TMPDIR}/consul.snap"
+
+  # Reinstalling deletes the PVCs so the new servers start without any state.
+  helm_delete
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+  run consul_exec kv get snapshot/test
+  [ "$status" -ne 0 ]
+
+  consul_snapshot_restore "${BATS_TMPDIR}/consul.snap"
+  [ "$(consul_exec kv get snapshot/test)" = "value" ]
+}
+
+@test "server/snapshot: deleted state comes back when a snapshot is restored with ACLs enabled" {
+  helm_install --set 'global.acls.manageSystemACLs=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  CONSUL_HTTP_TOKEN=$(acl_bootstrap_token)
+  export CONSUL_HTTP_TOKEN
+
+  consul_exec kv put snapshot/test value
+  consul_snapshot_save "${BATS_TMPDIR}/consul.snap"
+  consul_exec kv delete snapshot/test
+  run consul_exec kv get snapshot/test
+  [ "$status" -ne 0 ]
+
+  consul_snapshot_restore "${BATS_TMPDIR}/consul.snap"
+  [ "$(consul_exec kv get snapshot/test)" = "value" ]
+}
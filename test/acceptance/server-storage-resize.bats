@@ -0,0 +1,35 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/storage-resize: server PVCs can be expanded in place" {
+  helm_install --set 'server.storage=10Gi'
+  wait_for_ready $(name_prefix)-consul-server-0
+  skip_unless_volume_expansion
+  [ "$(pvc_sizes)" = "10Gi,10Gi,10Gi" ]
+
+  kv_put storage-resize/test value
+
+  # The StatefulSet's volumeClaimTemplates can't be changed, so upgrading
+  # with a larger server.storage is rejected rather than resizing anything.
+  run helm_upgrade --set 'server.storage=20Gi'
+  [ "$status" -ne 0 ]
+  [[ "$output" =~ "Forbidden" ]]
+
+  # Instead each PVC is expanded, keeping the servers' data.
+  for pvc in $(kubectl get pvc -l "release=$(name_prefix)" -o name); do
+    kubectl patch ${pvc} -p '{"spec": {"resources": {"requests": {"storage": "20Gi"}}}}'
+  done
+  for i in $(seq 60); do
+    if [ "$(pvc_sizes)" = "20Gi,20Gi,20Gi" ]; then
+      break
+    fi
+    sleep 5
+  done
+  [ "$(pvc_sizes)" = "20Gi,20Gi,20Gi" ]
+  assert_kv storage-resize/test value
+}
@@ -0,0 +1,53 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  rm -f "${BATS_TMPDIR}/ca.pem" "${BATS_TMPDIR}/ca-key.pem" "${BATS_TMPDIR}/server.pem"
+  helm_delete
+}
+
+@test "server/tls-ca: the generated CA is reused across upgrades" {
+  helm_install --set 'global.tls.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  local fingerprint=$(ca_cert_fingerprint)
+  [ -n "${fingerprint}" ]
+
+  # The TLS init job runs again on upgrade but must keep the existing CA.
+  helm_upgrade --set 'global.tls.enabled=true'
+  [ "$(ca_cert_fingerprint)" = "${fingerprint}" ]
+}
+
+@test "server/tls-ca: deleting the CA secrets rotates the CA on upgrade" {
+  helm_install --set 'global.tls.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+  local fingerprint=$(ca_cert_fingerprint)
+
+  kubectl delete secret \
+      "$(name_prefix)-consul-ca-cert" "$(name_prefix)-consul-ca-key" "$(name_prefix)-consul-server-cert"
+  helm_upgrade --set 'global.tls.enabled=true'
+
+  local rotated=$(ca_cert_fingerprint)
+  [ -n "${rotated}" ]
+  [ "${rotated}" != "${fingerprint}" ]
+}
+
+@test "server/tls-ca: a CA provided in a secret signs the server certificates" {
+  openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes -days 1 \
+      -subj "/CN=Test Consul CA" -addext "basicConstraints=critical,CA:TRUE" \
+      -addext "keyUsage=critical,keyCertSign,cRLSign,digitalSignature" \
+      -keyout "${BATS_TMPDIR}/ca-key.pem" -out "${BATS_TMPDIR}/ca.pem"
+  create_tls_secret consul-external-ca "${BATS_TMPDIR}/ca.pem" "${BATS_TMPDIR}/ca-key.pem"
+
+  helm_install \
+      --set 'global.tls.enabled=true' \
+      --set 'global.tls.caCert.secretName=consul-external-ca' \
+      --set 'global.tls.caCert.secretKey=tls.crt' \
+      --set 'global.tls.caKey.secretName=consul-external-ca' \
+      --set 'global.tls.caKey.secretKey=tls.key'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl get secret "$(name_prefix)-consul-server-cert" -o jsonpath='{.data.tls\.crt}' |
+      base64 --decode > "${BATS_TMPDIR}/server.pem"
+  openssl verify -CAfile "${BATS_TMPDIR}/ca.pem" "${BATS_TMPDIR}/server.pem"
+}
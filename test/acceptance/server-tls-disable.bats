@@ -0,0 +1,47 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+# assert_plaintext_only fails unless every server and client agent of the
+# release serves HTTP on 8500 and nothing on 8501.
+assert_plaintext_only() {
+  for pod in $(kubectl get pods -l "release=$(name_prefix),component in (server,client)" -o name); do
+    kubectl exec ${pod#pod/} -- curl -sSf http://127.0.0.1:8500/v1/status/leader
+    run kubectl exec ${pod#pod/} -- curl -sSk https://127.0.0.1:8501/v1/status/leader
+    [ "$status" -ne 0 ]
+  done
+}
+
+@test "server/TLS: disabling TLS on upgrade converges to plaintext" {
+  helm_install \
+      --set 'global.tls.enabled=true' \
+      --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  helm_upgrade_reset --set 'connectInject.enabled=true'
+  kubectl rollout status --timeout=$(scaled_timeout 300)s "statefulset/$(name_prefix)-consul-server"
+  kubectl rollout status --timeout=$(scaled_timeout 300)s "daemonset/$(name_prefix)-consul"
+  wait_for_leader
+  assert_plaintext_only
+
+  # The sidecars were injected with TLS settings for the client agents so
+  # the apps have to be restarted to pick up plaintext ones.
+  kubectl rollout restart deploy/static-server deploy/static-client
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  local client=$(pod_name app=static-client)
+  wait_for_envoy_endpoints ${client} static-server 1
+  [[ "$(kubectl exec ${client} -c static-client -- curl -sSf http://localhost:1234)" =~ "hello world" ]]
+}
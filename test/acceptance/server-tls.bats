@@ -0,0 +1,54 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "server/TLS: only HTTPS is served when httpsOnly is true" {
+  helm_install \
+      --set 'global.tls.enabled=true' \
+      --set 'global.tls.httpsOnly=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  [ "$(consul_port_accepts http 8500)" = "false" ]
+  [ "$(consul_port_accepts https 8501)" = "true" ]
+}
+
+@test "server/TLS: both HTTP and HTTPS are served when httpsOnly is false" {
+  helm_install \
+      --set 'global.tls.enabled=true' \
+      --set 'global.tls.httpsOnly=false'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  [ "$(consul_port_accepts http 8500)" = "true" ]
+  [ "$(consul_port_accepts https 8501)" = "true" ]
+}
+
+@test "server/TLS: only HTTP is served when TLS is disabled" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  [ "$(consul_port_accepts http 8500)" = "true" ]
+  [ "$(consul_port_accepts https 8501)" = "false" ]
+}
+
+@test "server/TLS: RPC without a client certificate is refused when verify is true" {
+  helm_install \
+      --set 'global.tls.enabled=true' \
+      --set 'global.tls.verify=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  [ "$(consul_rpc_accepts without-cert)" = "false" ]
+  [ "$(consul_rpc_accepts with-cert)" = "true" ]
+}
+
+@test "server/TLS: RPC without a client certificate is accepted when verify is false" {
+  helm_install \
+      --set 'global.tls.enabled=true' \
+      --set 'global.tls.verify=false'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  [ "$(consul_rpc_accepts without-cert)" = "true" ]
+}
@@ -12,7 +12,13 @@ load _helpers
       wc -l)
   [ "${server_count}" -eq "3" ]
 
-  helm test consul
+  # Verify nothing went wrong that doesn't show up in readiness
+  assert_logs_do_not_contain component=server \
+      "error getting server health" \
+      "raft: failed to" \
+      "panic:"
+
+  helm test "$(name_prefix)"
 
   # Clean up
   helm_delete
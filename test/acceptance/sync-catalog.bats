@@ -0,0 +1,56 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  helm_delete
+}
+
+@test "sync-catalog: Kubernetes services are registered in Consul with their endpoints" {
+  helm_install --set 'syncCatalog.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/static-server.yaml"
+  kubectl scale deploy/static-server --replicas=2
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-server
+
+  # Synced services are suffixed with their namespace and tagged "k8s".
+  local service="static-server-${TEST_NAMESPACE:-default}"
+  assert_service_registered ${service} 2
+  assert_service_healthy ${service} 2
+  [ "$(consul_api /v1/catalog/service/${service} | jq -r '[ .[].ServiceTags | index("k8s") ] | all')" = "true" ]
+}
+
+@test "sync-catalog: Consul services are synced to Kubernetes as ExternalName services" {
+  helm_install \
+      --set 'syncCatalog.enabled=true' \
+      --set 'syncCatalog.toConsul=false' \
+      --set 'syncCatalog.toK8S=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  # The synced service is deleted after the Consul service is deregistered,
+  # as cleanups run in reverse, so that sync-catalog doesn't recreate it.
+  register_cleanup kubectl delete --ignore-not-found service external-server
+  register_external_service external-server 10.0.0.10 80
+
+  local service
+  service=$(wait_for_k8s_service external-server)
+  echo "${service}"
+  [[ "${service}" =~ ^"ExternalName external-server.service." ]]
+
+  # Without toConsul, Kubernetes services aren't registered in Consul.
+  deploy_static_server --no-inject
+  sleep 10
+  [ "$(consul_api /v1/catalog/service/static-server-${TEST_NAMESPACE:-default} | jq length)" = "0" ]
+
+  deregister_external_service external-server
+  for i in $(seq 30); do
+    if ! kubectl get service external-server > /dev/null 2>&1; then
+      return
+    fi
+    sleep 2
+  done
+  echo "external-server was not deleted after its Consul service was deregistered."
+  return 1
+}
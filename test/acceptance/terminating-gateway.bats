@@ -0,0 +1,145 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/terminating-client.yaml"
+  kubectl delete --ignore-not-found -f "${BATS_TEST_DIRNAME}/fixtures/external-https-server.yaml"
+  rm -f "${BATS_TMPDIR}"/external-https-*.pem "${BATS_TMPDIR}"/external-https-*.srl
+  helm_delete
+}
+
+# current_namespace outputs the namespace the tests run in.
+current_namespace() {
+  local namespace=$(kubectl config view --minify -o jsonpath='{..namespace}')
+  echo "${namespace:-default}"
+}
+
+# deploy_external_server applies the external-server fixture, whose
+# ExternalName service points at its backend in the current namespace.
+deploy_external_server() {
+  kubectl_apply_template "${BATS_TEST_DIRNAME}/fixtures/external-server.yaml" \
+      NAMESPACE="$(current_namespace)"
+}
+
+# create_external_https_secrets creates a test CA and a certificate it
+# signed for external-https-server, stores the certificate and its key in
+# the external-https-server-tls secret that the external-https-server
+# fixture serves with, and the CA in the external-https-ca secret, which
+# the gateway mounts to verify the server.
+create_external_https_secrets() {
+  local dir="${BATS_TMPDIR}"
+  openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes -days 1 \
+      -subj "/CN=Test External CA" -addext "basicConstraints=critical,CA:TRUE" \
+      -addext "keyUsage=critical,keyCertSign,cRLSign,digitalSignature" \
+      -keyout "${dir}/external-https-ca-key.pem" -out "${dir}/external-https-ca.pem"
+  openssl req -new -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes \
+      -subj "/CN=external-https-server" \
+      -keyout "${dir}/external-https-server-key.pem" -out "${dir}/external-https-server-csr.pem"
+  openssl x509 -req -days 1 -in "${dir}/external-https-server-csr.pem" \
+      -CA "${dir}/external-https-ca.pem" -CAkey "${dir}/external-https-ca-key.pem" \
+      -CAcreateserial -CAserial "${dir}/external-https-ca.srl" \
+      -extfile <(printf 'subjectAltName=DNS:external-https-server') \
+      -out "${dir}/external-https-server.pem"
+
+  create_tls_secret external-https-server-tls \
+      "${dir}/external-https-server.pem" "${dir}/external-https-server-key.pem"
+  create_secret external-https-ca ca.crt="$(cat "${dir}/external-https-ca.pem")"
+}
+
+# register_external_server registers the external-server deployment's
+# Kubernetes service in the catalog as a service outside the mesh.
+register_external_server() {
+  register_external_service external-server \
+      "external-server.$(current_namespace).svc.cluster.local" 80
+}
+
+# client_curl curls the given URL from the static-client pod, retrying
+# while the route through the gateway is being configured.
+client_curl() {
+  local pod=$(pod_name app=static-client)
+  for i in $(seq 30); do
+    if kubectl exec "${pod}" -c static-client -- curl -sSf "$@"; then
+      return
+    fi
+    sleep 2
+  done
+  return 1
+}
+
+# wait_for_client_curl_failure waits until curling the given URL from the
+# static-client pod fails, e.g. once a deny intention has propagated.
+wait_for_client_curl_failure() {
+  local pod=$(pod_name app=static-client)
+  for i in $(seq 30); do
+    if ! kubectl exec "${pod}" -c static-client -- curl -sSf "$@"; then
+      return
+    fi
+    sleep 2
+  done
+  return 1
+}
+
+@test "terminating-gateway: mesh apps reach external services through the gateway" {
+  # The gateway mounts the test CA that signed the HTTPS server's
+  # certificate, so the secrets have to exist before it starts.
+  create_external_https_secrets
+
+  # The external servers aren't part of the mesh so they are deployed while
+  # the chart installs.
+  helm_install_async \
+      --set 'connectInject.enabled=true' \
+      --set 'terminatingGateways.enabled=true' \
+      --set 'terminatingGateways.defaults.replicas=1' \
+      --set 'terminatingGateways.defaults.extraVolumes[0].type=secret' \
+      --set 'terminatingGateways.defaults.extraVolumes[0].name=external-https-ca'
+  deploy_external_server
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/external-https-server.yaml"
+  wait_for_install
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  register_external_server
+  register_external_service external-https-server \
+      "external-https-server.$(current_namespace).svc.cluster.local" 443
+  config_write "${BATS_TEST_DIRNAME}/fixtures/terminating-gateway.hcl"
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/terminating-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/external-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/external-https-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  # Plain HTTP to the ExternalName service.
+  [[ "$(client_curl http://localhost:1234)" =~ "hello external" ]]
+
+  # TLS to the external service is originated by the gateway and verified
+  # against the test CA configured in the terminating-gateway config entry.
+  [[ "$(client_curl http://localhost:1235)" =~ "hello external tls" ]]
+
+  # Intentions gate traffic through the gateway.
+  kubectl exec "$(name_prefix)-consul-server-0" -- \
+      consul intention create -deny static-client external-server
+  wait_for_intention static-client external-server deny
+  wait_for_client_curl_failure http://localhost:1234
+}
+
+@test "terminating-gateway: with ACLs the gateway is allowed to represent linked services" {
+  helm_install \
+      --set 'global.acls.manageSystemACLs=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'terminatingGateways.enabled=true' \
+      --set 'terminatingGateways.defaults.replicas=1'
+  wait_for_ready $(name_prefix)-consul-server-0
+  export CONSUL_HTTP_TOKEN=$(acl_bootstrap_token)
+
+  deploy_external_server
+  register_external_server
+  link_terminating_gateway terminating-gateway external-server
+  consul_exec intention create -allow static-client external-server
+  wait_for_intention static-client external-server allow
+
+  kubectl apply -f "${BATS_TEST_DIRNAME}/fixtures/terminating-client.yaml"
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/external-server
+  kubectl rollout status --timeout=$(scaled_timeout 120)s deploy/static-client
+
+  [[ "$(client_curl http://localhost:1234)" =~ "hello external" ]]
+}
@@ -0,0 +1,54 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+teardown() {
+  helm_delete
+}
+
+@test "upgrade: re-applying identical values doesn't restart servers or clients" {
+  helm_install --set 'connectInject.enabled=true'
+  wait_for_ready $(name_prefix)-consul-server-0
+
+  local server_uids=$(pod_uids component=server)
+  local client_uids=$(pod_uids component=client)
+  local server_generation=$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.metadata.generation}')
+
+  helm_upgrade --set 'connectInject.enabled=true'
+
+  # Any non-determinism in the templates (random values, timestamps) would
+  # change the pod templates and roll the servers and clients.
+  [ "$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.metadata.generation}')" = "${server_generation}" ]
+  [ "$(pod_uids component=server)" = "${server_uids}" ]
+  [ "$(pod_uids component=client)" = "${client_uids}" ]
+}
+
+@test "upgrade: each upgrade deploys a new revision of the release" {
+  helm_install
+  wait_for_ready $(name_prefix)-consul-server-0
+  assert_release_deployed 1
+
+  helm_upgrade --set 'connectInject.enabled=true'
+  assert_release_deployed 2
+
+  helm_upgrade --set 'connectInject.enabled=true' --set 'syncCatalog.enabled=true'
+  assert_release_deployed 3
+  [ "$(release_history | awk '{print $1}' | tr '\n' ' ')" = "1 2 3 " ]
+  release_resources | grep -qx "Deployment/$(name_prefix)-consul-sync-catalog"
+}
+
+@test "upgrade: data survives upgrading Consul from the previous version" {
+  # The target is the image the tests install, i.e. CONSUL_IMAGE or the
+  # chart's default.
+  local target=${CONSUL_IMAGE:-$(helm show values "$(chart_path)" | yq -r '.global.image')}
+  helm_install --set "global.image=${UPGRADE_FROM_CONSUL_IMAGE:-consul:1.8.0}"
+  wait_for_ready $(name_prefix)-consul-server-0
+  wait_for_raft_healthy 3
+  kv_put upgrade/test before
+
+  upgrade_image "${target}"
+  assert_release_deployed 2
+  [ "$(kubectl get statefulset "$(name_prefix)-consul-server" -o jsonpath='{.spec.template.spec.containers[0].image}')" = "${target}" ]
+  [[ "$(consul_exec version)" =~ "Consul v${target##*:}" ]]
+  assert_kv upgrade/test before
+}
@@ -40,3 +40,61 @@ v2() {
     echo 1
   fi
 }
+
+# Usage: connect_inject_command [flags]
+# connect_inject_command outputs the script run by the connect-inject
+# container when the chart is rendered with connect injection enabled and
+# the given flags, e.g. --set 'connectInject.default=true'.
+connect_inject_command() {
+  cd `chart_dir`
+  helm template \
+      -s templates/connect-inject-deployment.yaml \
+      --set 'connectInject.enabled=true' \
+      "$@" \
+      . | tee /dev/stderr |
+      yq -r '.spec.template.spec.containers[0].command[2]'
+}
+
+# Usage: assert_arg <command> <arg>
+# assert_arg fails unless the given script passes exactly the given
+# argument, e.g. assert_arg "${cmd}" '-default-inject=true'.
+assert_arg() {
+  echo "$1" | sed -e 's/^ *//' -e 's/ *\\$//' | grep -qxF -- "$2"
+}
+
+# Usage: assert_no_arg <command> <flag>
+# assert_no_arg fails if the given script passes the given flag with any
+# value, e.g. assert_no_arg "${cmd}" '-enable-namespaces'.
+assert_no_arg() {
+  ! echo "$1" | sed -e 's/^ *//' | grep -q -- "^$2\(=\| \|$\)"
+}
+
+# Usage: render_template <template> [flags]
+# render_template renders only the given template with the given flags and
+# outputs the rendered YAML, e.g.
+# render_template templates/server-statefulset.yaml --set 'server.replicas=5'.
+# If helm fails, its error is output on stderr so it shows up in the test's
+# output instead of an empty document being asserted on.
+render_template() {
+  cd `chart_dir`
+  local stderr="${BATS_TMPDIR}/render-template-stderr"
+  local output
+  if ! output=$(helm template -s "$1" "${@:2}" . 2> "${stderr}"); then
+    echo "helm template failed to render $1:" >&2
+    cat "${stderr}" >&2
+    return 1
+  fi
+  echo "${output}" | tee /dev/stderr
+}
+
+# Usage: assert_render_error <template> <message> [flags]
+# assert_render_error fails unless rendering the given template with the
+# given flags fails with an error containing the given message, e.g.
+# assert_render_error templates/client-daemonset.yaml 'must be true' --set 'client.grpc=false'.
+assert_render_error() {
+  cd `chart_dir`
+  run helm template -s "$1" "${@:3}" .
+  echo "${output}" >&2
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "$2" ]]
+}
@@ -15,6 +15,7 @@ load _helpers
       -s templates/connect-inject-deployment.yaml  \
       --set 'global.enabled=false' \
       --set 'client.enabled=true' \
+      --set 'client.join[0]=consul.example.com' \
       --set 'connectInject.enabled=true' \
       . | tee /dev/stderr |
       yq 'length > 0' | tee /dev/stderr)
@@ -58,6 +59,41 @@ load _helpers
   [[ "$output" =~ "clients must be enabled for connect injection" ]]
 }
 
+@test "connectInject/Deployment: fails if there are no servers to connect to" {
+  cd `chart_dir`
+  run helm template \
+      -s templates/connect-inject-deployment.yaml  \
+      --set 'server.enabled=false' \
+      --set 'connectInject.enabled=true' .
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "server.enabled, externalServers.enabled or client.join must be set for connect injection" ]]
+}
+
+@test "connectInject/Deployment: enable with externalServers.enabled instead of servers" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/connect-inject-deployment.yaml  \
+      --set 'server.enabled=false' \
+      --set 'externalServers.enabled=true' \
+      --set 'externalServers.hosts[0]=consul.example.com' \
+      --set 'connectInject.enabled=true' \
+      . | tee /dev/stderr |
+      yq 'length > 0' | tee /dev/stderr)
+  [ "${actual}" = "true" ]
+}
+
+@test "connectInject/Deployment: enable with client.join instead of servers" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/connect-inject-deployment.yaml  \
+      --set 'server.enabled=false' \
+      --set 'client.join[0]=consul.example.com' \
+      --set 'connectInject.enabled=true' \
+      . | tee /dev/stderr |
+      yq 'length > 0' | tee /dev/stderr)
+  [ "${actual}" = "true" ]
+}
+
 @test "connectInject/Deployment: fails if global.enabled=false and client.enabled=false" {
   cd `chart_dir`
   run helm template \
@@ -1287,3 +1323,45 @@ load _helpers
     yq 'any(contains("-default-sidecar-proxy-cpu-limit=0"))' | tee /dev/stderr)
   [ "${actual}" = "true" ]
 }
+
+#--------------------------------------------------------------------
+# args
+
+@test "connectInject/Deployment: args by default" {
+  local cmd=$(connect_inject_command)
+  assert_arg "${cmd}" '-default-inject=false'
+  assert_arg "${cmd}" '-listen=:8080'
+  assert_arg "${cmd}" '-enable-central-config=true'
+  assert_arg "${cmd}" '-allow-k8s-namespace="*"'
+  assert_no_arg "${cmd}" '-default-protocol'
+  assert_no_arg "${cmd}" '-deny-k8s-namespace'
+  assert_no_arg "${cmd}" '-enable-namespaces'
+  assert_no_arg "${cmd}" '-acl-auth-method'
+}
+
+@test "connectInject/Deployment: args with connectInject.default=true" {
+  local cmd=$(connect_inject_command --set 'connectInject.default=true')
+  assert_arg "${cmd}" '-default-inject=true'
+}
+
+@test "connectInject/Deployment: args with global.enableConsulNamespaces=true" {
+  local cmd=$(connect_inject_command \
+      --set 'global.enableConsulNamespaces=true' \
+      --set 'connectInject.consulNamespaces.mirroringK8S=true')
+  assert_arg "${cmd}" '-enable-namespaces=true'
+  assert_arg "${cmd}" '-consul-destination-namespace=default'
+  assert_arg "${cmd}" '-enable-k8s-namespace-mirroring=true'
+}
+
+@test "connectInject/Deployment: args with centralConfig.defaultProtocol and k8sDenyNamespaces" {
+  local cmd=$(connect_inject_command \
+      --set 'connectInject.centralConfig.defaultProtocol=http' \
+      --set 'connectInject.k8sDenyNamespaces[0]=kube-system')
+  assert_arg "${cmd}" '-default-protocol="http"'
+  assert_arg "${cmd}" '-deny-k8s-namespace="kube-system"'
+}
+
+@test "connectInject/Deployment: args with global.acls.manageSystemACLs=true" {
+  local cmd=$(connect_inject_command --set 'global.acls.manageSystemACLs=true')
+  assert_arg "${cmd}" '-acl-auth-method="release-name-consul-k8s-auth-method"'
+}
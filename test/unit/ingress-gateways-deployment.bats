@@ -72,6 +72,23 @@ load _helpers
   [[ "$output" =~ "clients must be enabled" ]]
 }
 
+@test "ingressGateways/Deployment: fails if a gateway has no name" {
+  assert_render_error templates/ingress-gateways-deployment.yaml \
+      "Ingress gateway names cannot be empty" \
+      --set 'ingressGateways.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.gateways[0].name='
+}
+
+@test "ingressGateways/Deployment: fails if gateway names aren't unique" {
+  assert_render_error templates/ingress-gateways-deployment.yaml \
+      "Ingress gateway names must be unique" \
+      --set 'ingressGateways.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.gateways[0].name=gateway1' \
+      --set 'ingressGateways.gateways[1].name=gateway1'
+}
+
 #--------------------------------------------------------------------
 # envoyImage
 
@@ -286,6 +303,18 @@ load _helpers
   [ "${actual}" = "12" ]
 }
 
+@test "ingressGateways/Deployment: replicas default applies to gateways that don't set their own" {
+  local actual=$(render_template templates/ingress-gateways-deployment.yaml \
+      --set 'ingressGateways.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'ingressGateways.defaults.replicas=3' \
+      --set 'ingressGateways.gateways[0].name=gateway1' \
+      --set 'ingressGateways.gateways[0].replicas=12' \
+      --set 'ingressGateways.gateways[1].name=gateway2' \
+      | yq -s -r '[ .[].spec.replicas ] | join(",")' | tee /dev/stderr)
+  [ "${actual}" = "12,3" ]
+}
+
 #--------------------------------------------------------------------
 # ports
 
@@ -42,3 +42,35 @@ load _helpers
   [ "${actual}" = "my-secret2" ]
 }
 
+
+#--------------------------------------------------------------------
+# serviceAccount.annotations
+
+@test "meshGateway/ServiceAccount: no annotations by default" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/mesh-gateway-serviceaccount.yaml  \
+      --set 'meshGateway.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      . | tee /dev/stderr |
+      yq -r '.metadata.annotations' | tee /dev/stderr)
+  [ "${actual}" = "null" ]
+}
+
+@test "meshGateway/ServiceAccount: annotations can be set" {
+  cd `chart_dir`
+  local object=$(helm template \
+      -s templates/mesh-gateway-serviceaccount.yaml  \
+      --set 'meshGateway.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'meshGateway.serviceAccount.annotations=key1: value1
+key2: value2' \
+      . | tee /dev/stderr |
+      yq -r '.metadata.annotations' | tee /dev/stderr)
+
+  local actual=$(echo $object | yq -r '.key1' | tee /dev/stderr)
+  [ "${actual}" = "value1" ]
+
+  local actual=$(echo $object | yq -r '.key2' | tee /dev/stderr)
+  [ "${actual}" = "value2" ]
+}
@@ -38,6 +38,18 @@ load _helpers
       .
 }
 
+#--------------------------------------------------------------------
+# conflicting values
+
+@test "server/StatefulSet: fails if global.tls.enableAutoEncrypt=true and global.tls.enabled=false" {
+  cd `chart_dir`
+  run helm template \
+      -s templates/server-statefulset.yaml  \
+      --set 'global.tls.enableAutoEncrypt=true' .
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "global.tls.enabled must be true if global.tls.enableAutoEncrypt is true" ]]
+}
+
 #--------------------------------------------------------------------
 # retry-join
 
@@ -138,6 +150,28 @@ load _helpers
   [ "${actual}" = "2" ]
 }
 
+#--------------------------------------------------------------------
+# terminationGracePeriodSeconds
+
+@test "server/StatefulSet: terminationGracePeriodSeconds defaults to 30" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/server-statefulset.yaml  \
+      . | tee /dev/stderr |
+      yq -r '.spec.template.spec.terminationGracePeriodSeconds' | tee /dev/stderr)
+  [ "${actual}" = "30" ]
+}
+
+@test "server/StatefulSet: terminationGracePeriodSeconds can be set" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/server-statefulset.yaml  \
+      --set 'server.terminationGracePeriodSeconds=90' \
+      . | tee /dev/stderr |
+      yq -r '.spec.template.spec.terminationGracePeriodSeconds' | tee /dev/stderr)
+  [ "${actual}" = "90" ]
+}
+
 #--------------------------------------------------------------------
 # storageClass
 
@@ -160,6 +194,42 @@ load _helpers
   [ "${actual}" = "foo" ]
 }
 
+#--------------------------------------------------------------------
+# dataDirectory
+
+@test "server/StatefulSet: data volume is mounted at /consul/data by default" {
+  cd `chart_dir`
+  local object=$(helm template \
+      -s templates/server-statefulset.yaml  \
+      . | tee /dev/stderr |
+      yq '.spec.template.spec.containers[0]' | tee /dev/stderr)
+
+  local actual=$(echo $object |
+      yq -r '.volumeMounts[] | select(.name | startswith("data-")) | .mountPath' | tee /dev/stderr)
+  [ "${actual}" = "/consul/data" ]
+
+  local actual=$(echo $object |
+      yq -r '.command | any(contains("-data-dir=/consul/data"))' | tee /dev/stderr)
+  [ "${actual}" = "true" ]
+}
+
+@test "server/StatefulSet: data volume mount and data dir can be set with server.dataDirectory" {
+  cd `chart_dir`
+  local object=$(helm template \
+      -s templates/server-statefulset.yaml  \
+      --set 'server.dataDirectory=/consul/state' \
+      . | tee /dev/stderr |
+      yq '.spec.template.spec.containers[0]' | tee /dev/stderr)
+
+  local actual=$(echo $object |
+      yq -r '.volumeMounts[] | select(.name | startswith("data-")) | .mountPath' | tee /dev/stderr)
+  [ "${actual}" = "/consul/state" ]
+
+  local actual=$(echo $object |
+      yq -r '.command | any(contains("-data-dir=/consul/state"))' | tee /dev/stderr)
+  [ "${actual}" = "true" ]
+}
+
 #--------------------------------------------------------------------
 # extraVolumes
 
@@ -42,6 +42,91 @@ load _helpers
   [ "${actual}" = "my-secret2" ]
 }
 
+#--------------------------------------------------------------------
+# serviceAccount.annotations
+
+@test "terminatingGateways/ServiceAccount: no annotations by default" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/terminating-gateways-serviceaccount.yaml  \
+      --set 'terminatingGateways.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      . | tee /dev/stderr |
+      yq -s -r '.[0].metadata.annotations' | tee /dev/stderr)
+  [ "${actual}" = "null" ]
+}
+
+@test "terminatingGateways/ServiceAccount: annotations can be set through defaults" {
+  cd `chart_dir`
+  local object=$(helm template \
+      -s templates/terminating-gateways-serviceaccount.yaml  \
+      --set 'terminatingGateways.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'terminatingGateways.defaults.serviceAccount.annotations=key1: value1
+key2: value2' \
+      . | tee /dev/stderr |
+      yq -s -r '.[0].metadata.annotations' | tee /dev/stderr)
+
+  local actual=$(echo $object | yq '. | length' | tee /dev/stderr)
+  [ "${actual}" = "2" ]
+
+  local actual=$(echo $object | yq -r '.key1' | tee /dev/stderr)
+  [ "${actual}" = "value1" ]
+
+  local actual=$(echo $object | yq -r '.key2' | tee /dev/stderr)
+  [ "${actual}" = "value2" ]
+}
+
+@test "terminatingGateways/ServiceAccount: annotations can be set through specific gateway" {
+  cd `chart_dir`
+  local object=$(helm template \
+      -s templates/terminating-gateways-serviceaccount.yaml  \
+      --set 'terminatingGateways.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'terminatingGateways.gateways[0].name=gateway1' \
+      --set 'terminatingGateways.gateways[0].serviceAccount.annotations=key1: value1
+key2: value2' \
+      . | tee /dev/stderr |
+      yq -s -r '.[0].metadata.annotations' | tee /dev/stderr)
+
+  local actual=$(echo $object | yq '. | length' | tee /dev/stderr)
+  [ "${actual}" = "2" ]
+
+  local actual=$(echo $object | yq -r '.key1' | tee /dev/stderr)
+  [ "${actual}" = "value1" ]
+
+  local actual=$(echo $object | yq -r '.key2' | tee /dev/stderr)
+  [ "${actual}" = "value2" ]
+}
+
+@test "terminatingGateways/ServiceAccount: annotations can be set through defaults and specific gateway" {
+  cd `chart_dir`
+  local object=$(helm template \
+      -s templates/terminating-gateways-serviceaccount.yaml  \
+      --set 'terminatingGateways.enabled=true' \
+      --set 'connectInject.enabled=true' \
+      --set 'terminatingGateways.defaults.serviceAccount.annotations=defaultkey: defaultvalue' \
+      --set 'terminatingGateways.gateways[0].name=gateway1' \
+      --set 'terminatingGateways.gateways[0].serviceAccount.annotations=key1: value1
+key2: value2' \
+      --set 'terminatingGateways.gateways[1].name=gateway2' \
+      . | tee /dev/stderr |
+      yq -s -r '.' | tee /dev/stderr)
+
+  local actual=$(echo $object | yq '.[0].metadata.annotations | length' | tee /dev/stderr)
+  [ "${actual}" = "3" ]
+
+  local actual=$(echo $object | yq -r '.[0].metadata.annotations.defaultkey' | tee /dev/stderr)
+  [ "${actual}" = "defaultvalue" ]
+
+  local actual=$(echo $object | yq -r '.[0].metadata.annotations.key1' | tee /dev/stderr)
+  [ "${actual}" = "value1" ]
+
+  # Gateway-specific annotations don't leak into other gateways.
+  local actual=$(echo $object | yq -c '.[1].metadata.annotations' | tee /dev/stderr)
+  [ "${actual}" = '{"defaultkey":"defaultvalue"}' ]
+}
+
 #--------------------------------------------------------------------
 # multiple gateways
 
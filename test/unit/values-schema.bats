@@ -0,0 +1,39 @@
+#!/usr/bin/env bats
+
+load _helpers
+
+@test "values/schema: known top-level keys are accepted" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/server-statefulset.yaml  \
+      --set 'ingressGateways.enabled=false' \
+      --set 'fullnameOverride=override' \
+      . | tee /dev/stderr |
+      yq -r '.kind' | tee /dev/stderr)
+  [ "${actual}" = "StatefulSet" ]
+}
+
+@test "values/schema: misspelled top-level keys are rejected" {
+  # Helm 2 doesn't support values schemas.
+  if [[ $(v2) ]]; then
+    skip "values schemas require Helm 3"
+  fi
+
+  cd `chart_dir`
+  run helm template \
+      -s templates/server-statefulset.yaml  \
+      --set 'ingresGateways.enabled=true' .
+  [ "$status" -eq 1 ]
+  [[ "$output" =~ "values don't meet the specifications of the schema" ]]
+  [[ "$output" =~ "ingresGateways" ]]
+}
+
+@test "values/schema: enabled is accepted for use as a subchart" {
+  cd `chart_dir`
+  local actual=$(helm template \
+      -s templates/server-statefulset.yaml  \
+      --set 'enabled=true' \
+      . | tee /dev/stderr |
+      yq -r '.kind' | tee /dev/stderr)
+  [ "${actual}" = "StatefulSet" ]
+}